@@ -0,0 +1,187 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// batchChunkSize is how many commands of a batch are written before their
+// responses are read. beanstalkd stops reading from a connection whose
+// responses aren't being consumed, so writing a large batch in one go could
+// deadlock once the socket buffers fill up.
+const batchChunkSize = 1000
+
+// PutJob is a job to be added by PutMany.
+type PutJob struct {
+	Body []byte
+	Opts PutOpts
+}
+
+// BatchError is returned by the batch commands when some items of a batch
+// failed. Errors is aligned with the batch, holding nil for the items that
+// succeeded.
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	return fmt.Sprintf(
+		"%d of %d batch items failed, first at index %d: %v",
+		len(failed),
+		len(e.Errors),
+		failed[0],
+		e.Errors[failed[0]],
+	)
+}
+
+// Is reports whether any item of the batch failed with target, so that
+// errors.Is(err, ErrNotFound) works on a batch error.
+func (e *BatchError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if err != nil && errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failed item matching target, as errors.As does, so that
+// the details of a *ProtocolError can be had from a batch error.
+func (e *BatchError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if err != nil && errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Failed returns the indexes of the items that failed.
+func (e *BatchError) Failed() []int {
+	var failed []int
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+// batchError returns a *BatchError for errs, or nil if no item failed.
+func batchError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// PutMany adds jobs in as few round trips as possible and returns their ids
+// in order. Jobs that are rejected by the server get a zero id, unless they
+// were buried, and are reported in a *BatchError without stopping the rest of
+// the batch. Any other error aborts the batch; ids then holds the ids received
+// so far.
+func (jackd *Client) PutMany(jobs []PutJob) ([]uint32, error) {
+	return jackd.PutManyContext(context.Background(), jobs)
+}
+
+func (jackd *Client) PutManyContext(ctx context.Context, jobs []PutJob) ([]uint32, error) {
+	ids := make([]uint32, len(jobs))
+	errs := make([]error, len(jobs))
+
+	err := jackd.batch(ctx, "put-many", len(jobs), func(i int) error {
+		return jackd.writePut(jackd.wrap(ctx, jobs[i].Body), jobs[i].Opts)
+	}, func(i int, resp string) error {
+		ids[i], errs[i] = parsePutResponse(resp)
+		errs[i] = describe(errs[i], "put", ids[i], jackd.tube)
+		return errs[i]
+	})
+	if err != nil {
+		return ids, err
+	}
+
+	return ids, batchError(errs)
+}
+
+// DeleteMany deletes jobs in as few round trips as possible. Jobs that can't
+// be deleted are reported in a *BatchError without stopping the rest of the
+// batch.
+func (jackd *Client) DeleteMany(jobs []uint32) error {
+	return jackd.DeleteManyContext(context.Background(), jobs)
+}
+
+func (jackd *Client) DeleteManyContext(ctx context.Context, jobs []uint32) error {
+	return jackd.simpleBatch(ctx, "delete-many", "delete", jobs, "DELETED")
+}
+
+// KickJobs kicks jobs in as few round trips as possible. Jobs that can't be
+// kicked are reported in a *BatchError without stopping the rest of the batch.
+func (jackd *Client) KickJobs(jobs []uint32) error {
+	return jackd.KickJobsContext(context.Background(), jobs)
+}
+
+func (jackd *Client) KickJobsContext(ctx context.Context, jobs []uint32) error {
+	return jackd.simpleBatch(ctx, "kick-jobs", "kick-job", jobs, "KICKED")
+}
+
+// simpleBatch runs command against each job, expecting the given response.
+// name names the whole batch.
+func (jackd *Client) simpleBatch(ctx context.Context, name string, command string, jobs []uint32, expected string) error {
+	errs := make([]error, len(jobs))
+
+	err := jackd.batch(ctx, name, len(jobs), func(i int) error {
+		_, err := fmt.Fprintf(jackd.buffer, "%s %d\r\n", command, jobs[i])
+		return err
+	}, func(i int, resp string) error {
+		errs[i] = describe(checkResponse(resp, expected, []string{NotFound}), command, jobs[i], "")
+		return errs[i]
+	})
+	if err != nil {
+		return err
+	}
+
+	return batchError(errs)
+}
+
+// batch runs n commands, writing them in chunks and reading back their
+// responses. Each chunk is reported as one command named name. write buffers
+// the command for an item and read handles its response line, returning the
+// item's error. The items failing don't stop the batch, unless the server's
+// response makes no sense: the batch then fails as a single command would.
+func (jackd *Client) batch(ctx context.Context, name string, n int, write func(i int) error, read func(i int, resp string) error) error {
+	for start := 0; start < n; start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > n {
+			end = n
+		}
+
+		err := jackd.exec(ctx, &operation{name: name}, func() error {
+			for i := start; i < end; i++ {
+				if err := write(i); err != nil {
+					return err
+				}
+			}
+			return jackd.buffer.Flush()
+		}, func() error {
+			for i := start; i < end; i++ {
+				resp, err := jackd.readLine()
+				if err != nil {
+					return err
+				}
+				var unexpectedErr *UnexpectedResponseError
+				if err := read(i, resp); errors.As(err, &unexpectedErr) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
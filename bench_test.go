@@ -0,0 +1,118 @@
+package jackd_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/getjackd/go-jackd"
+	"github.com/stretchr/testify/require"
+)
+
+// serveJob starts a server that answers every command with the same job, so
+// that benchmarks measure the client alone.
+func serveJob(b *testing.B, body []byte) string {
+	return serve(b, []byte(fmt.Sprintf("RESERVED 1 %d\r\n%s\r\n", len(body), body)))
+}
+
+// serve starts a server that answers every line it receives with response.
+func serve(tb testing.TB, response []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	serveOn(tb, listener, response)
+	return listener.Addr().String()
+}
+
+// serveOn is serve on a listener of the caller's choosing. A nil response
+// leaves every command unanswered.
+func serveOn(tb testing.TB, listener net.Listener, response []byte) {
+	tb.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveConn(conn, response)
+		}
+	}()
+}
+
+// serveConn answers every line received on conn with response, as serveOn
+// does.
+func serveConn(conn net.Conn, response []byte) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(line, "quit") {
+			return
+		}
+		if response == nil {
+			continue
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+func BenchmarkReserve(b *testing.B) {
+	for _, size := range []int{64, 4 << 10, 60 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			// Text made of CRLF terminated lines, like many real payloads
+			line := []byte("the quick brown fox jumps over the lazy dog\r\n")
+			body := bytes.Repeat(line, size/len(line)+1)[:size]
+
+			client, err := jackd.Dial(serveJob(b, body))
+			require.NoError(b, err)
+			defer client.Quit()
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, _, err := client.Reserve(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrentTouch(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts []jackd.Option
+	}{
+		{"serial", nil},
+		{"pipelined", []jackd.Option{jackd.WithPipelining()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client, err := jackd.Dial(serve(b, []byte("TOUCHED\r\n")), bench.opts...)
+			require.NoError(b, err)
+			defer client.Quit()
+
+			b.SetParallelism(16)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := client.Touch(1); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
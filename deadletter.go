@@ -0,0 +1,222 @@
+package jackd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DeadLetter is the body of a job in a dead-letter tube: a failed job along
+// with what is known about its failure.
+type DeadLetter struct {
+	// JobID is the ID the job had in its original tube.
+	JobID uint32 `json:"job_id"`
+	// Tube is the tube the job came from and is replayed into.
+	Tube     string        `json:"tube"`
+	Error    string        `json:"error"`
+	Attempts uint32        `json:"attempts"`
+	FailedAt time.Time     `json:"failed_at"`
+	Priority uint32        `json:"priority"`
+	TTR      time.Duration `json:"ttr"`
+	Body     []byte        `json:"body"`
+	// Headers are the headers of the job, if it was put in an envelope.
+	// They go along with the job when it is replayed.
+	Headers Headers `json:"headers,omitempty"`
+}
+
+// ParseDeadLetter decodes the body of a job found in a dead-letter tube.
+func ParseDeadLetter(body []byte) (*DeadLetter, error) {
+	letter := new(DeadLetter)
+	if err := json.Unmarshal(body, letter); err != nil {
+		return nil, fmt.Errorf("invalid dead letter: %w", err)
+	}
+	if letter.Tube == "" {
+		return nil, errors.New("invalid dead letter: no tube")
+	}
+	return letter, nil
+}
+
+// DeadLetter moves the job into the dead-letter tube, recording err as the
+// reason it failed. The job is put into the dead-letter tube before it is
+// deleted from its own, so that it is never lost, if at worst duplicated.
+func (job *Job) DeadLetter(tube string, err error) error {
+	return job.DeadLetterContext(context.Background(), tube, err)
+}
+
+func (job *Job) DeadLetterContext(ctx context.Context, tube string, err error) error {
+	if err := validateTubeName(tube); err != nil {
+		return err
+	}
+
+	return job.finalize(func() error {
+		stats, statsErr := job.client.JobStatsContext(ctx, job.ID)
+		if statsErr != nil {
+			return statsErr
+		}
+
+		letter := DeadLetter{
+			JobID:    job.ID,
+			Tube:     stats.Tube,
+			Attempts: stats.Reserves,
+			FailedAt: time.Now().UTC(),
+			Priority: stats.Priority,
+			TTR:      stats.TTR,
+			Body:     job.Body,
+			Headers:  job.Headers,
+		}
+		if err != nil {
+			letter.Error = err.Error()
+		}
+
+		body, marshalErr := json.Marshal(letter)
+		if marshalErr != nil {
+			return marshalErr
+		}
+
+		// The letter is plain JSON, whether the client uses envelopes or
+		// not, so that any client can replay it
+		if _, putErr := job.client.putInTube(ctx, tube, body, PutOpts{
+			Priority: stats.Priority,
+			TTR:      stats.TTR,
+		}); putErr != nil {
+			return putErr
+		}
+
+		return job.client.DeleteContext(ctx, job.ID)
+	})
+}
+
+// ReplayDeadLetters moves the ready jobs of a dead-letter tube back to their
+// original tubes, up to max jobs or all of them if max is zero, and returns
+// how many were moved. Jobs that aren't valid dead letters are buried in the
+// dead-letter tube. The tubes used and watched by the client are left as they
+// were.
+func (jackd *Client) ReplayDeadLetters(tube string, max int) (int, error) {
+	return jackd.ReplayDeadLettersContext(context.Background(), tube, max)
+}
+
+func (jackd *Client) ReplayDeadLettersContext(ctx context.Context, tube string, max int) (int, error) {
+	if err := validateTubeName(tube); err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for max == 0 || replayed < max {
+		var id uint32
+		err := jackd.inTube(ctx, &operation{name: "peek-ready", tube: tube}, func() error {
+			_, err := jackd.buffer.WriteString("peek-ready\r\n")
+			return err
+		}, func() (err error) {
+			id, _, err = jackd.responseJobChunk("FOUND", []string{NotFound})
+			return err
+		})
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		// Reserve the job, so that concurrent replays don't move it twice
+		job, err := jackd.ReserveJobByIDContext(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		// Letters put by a client using envelopes may be in one
+		_, body, err := DecodeEnvelope(job.Body)
+		var letter *DeadLetter
+		if err == nil {
+			letter, err = ParseDeadLetter(body)
+		}
+		if err != nil {
+			if err := job.BuryContext(ctx, 0); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+
+		// The job goes back as it was, in an envelope with its original
+		// headers if it had one, whatever the client's options
+		body = letter.Body
+		if letter.Headers != nil {
+			body = EncodeEnvelope(letter.Headers, letter.Body)
+		}
+		if _, err := jackd.putInTube(ctx, letter.Tube, body, PutOpts{
+			Priority: letter.Priority,
+			TTR:      letter.TTR,
+		}); err != nil {
+			return replayed, err
+		}
+		if err := job.DeleteContext(ctx); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// putInTube puts a job into tube without changing the tube in use. The body
+// is put as is, even if the client uses envelopes.
+func (jackd *Client) putInTube(ctx context.Context, tube string, body []byte, opts PutOpts) (id uint32, err error) {
+	op := &operation{name: "put", tube: tube, body: body}
+	op.args = putArgs(opts, int64(len(body)))
+
+	err = jackd.inTube(ctx, op, func() error {
+		return jackd.writePut(body, opts)
+	}, func() error {
+		id, err = jackd.putResponse(tube)
+		return err
+	})
+	return
+}
+
+// inTube runs a command that acts on the tube in use, such as put or
+// peek-ready, against op.tube instead. The command is surrounded by use
+// commands in a single exchange, so that no other command can run in between.
+func (jackd *Client) inTube(ctx context.Context, op *operation, write func() error, read func() error) error {
+	tube := op.tube
+	var previous string
+
+	// With pipelining, the tube in use is only known once the responses to
+	// the commands already sent are in
+	op.drain = true
+
+	return jackd.exec(ctx, op, func() error {
+		previous = jackd.tube
+
+		if _, err := fmt.Fprintf(jackd.buffer, "use %s\r\n", tube); err != nil {
+			return err
+		}
+		if err := write(); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(jackd.buffer, "use %s\r\n", previous); err != nil {
+			return err
+		}
+		return jackd.buffer.Flush()
+	}, func() error {
+		err := jackd.usingResponse(tube)
+		if readErr := read(); err == nil {
+			err = readErr
+		}
+		if restoreErr := jackd.usingResponse(previous); err == nil {
+			err = restoreErr
+		}
+		return err
+	})
+}
+
+func (jackd *Client) usingResponse(tube string) error {
+	resp, err := jackd.readLine()
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "USING "+tube, NoErrs)
+}
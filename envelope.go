@@ -0,0 +1,172 @@
+package jackd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An envelope is a job body prefixed with headers, see WithEnvelopes. It
+// starts with envelopeMagic and a version byte, followed by the length of the
+// headers as a big-endian uint32, the headers as a JSON object, and the body.
+const (
+	envelopeMagic   = "\x00jackd"
+	envelopeVersion = 1
+)
+
+var ErrInvalidEnvelope = errors.New("invalid envelope")
+
+// Well-known envelope headers.
+const (
+	// HeaderTraceparent and HeaderTracestate carry the W3C trace context.
+	HeaderTraceparent   = "traceparent"
+	HeaderTracestate    = "tracestate"
+	HeaderCorrelationID = "correlation-id"
+	// HeaderEnqueuedAt is when the job was put, in RFC 3339 format. It is
+	// set by the client.
+	HeaderEnqueuedAt  = "enqueued-at"
+	HeaderContentType = "content-type"
+)
+
+// Headers are the headers of a job put in an envelope.
+type Headers map[string]string
+
+// EnqueuedAt returns the time the job was put, or the zero time if unknown.
+func (h Headers) EnqueuedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, h[HeaderEnqueuedAt])
+	return t
+}
+
+// EncodeEnvelope puts body in an envelope with headers.
+func EncodeEnvelope(headers Headers, body []byte) []byte {
+	return append(envelopePrefix(headers), body...)
+}
+
+// envelopePrefix is what comes before the body in an envelope.
+func envelopePrefix(headers Headers) []byte {
+	if headers == nil {
+		headers = Headers{}
+	}
+	// A map of strings always marshals
+	encoded, _ := json.Marshal(headers)
+
+	prefix := make([]byte, 0, len(envelopeMagic)+5+len(encoded))
+	prefix = append(prefix, envelopeMagic...)
+	prefix = append(prefix, envelopeVersion)
+	prefix = append(prefix, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(prefix[len(prefix)-4:], uint32(len(encoded)))
+	return append(prefix, encoded...)
+}
+
+// DecodeEnvelope returns the headers and body of an envelope. Data that isn't
+// an envelope is returned as is, with nil headers, so that plain job bodies
+// can be told apart from envelopes.
+func DecodeEnvelope(data []byte) (Headers, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return nil, data, nil
+	}
+
+	rest := data[len(envelopeMagic):]
+	if len(rest) < 5 {
+		return nil, data, ErrInvalidEnvelope
+	}
+	if rest[0] != envelopeVersion {
+		return nil, data, fmt.Errorf("%w: unsupported version %d", ErrInvalidEnvelope, rest[0])
+	}
+
+	size := binary.BigEndian.Uint32(rest[1:5])
+	rest = rest[5:]
+	if uint64(size) > uint64(len(rest)) {
+		return nil, data, ErrInvalidEnvelope
+	}
+
+	var headers Headers
+	if err := json.Unmarshal(rest[:size], &headers); err != nil {
+		return nil, data, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if headers == nil {
+		headers = Headers{}
+	}
+
+	return headers, rest[size:], nil
+}
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a copy of ctx carrying headers, which a client
+// using envelopes puts along with the jobs it puts with that context.
+func ContextWithHeaders(ctx context.Context, headers Headers) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// ContextWithHeader returns a copy of ctx carrying the headers of ctx along
+// with the header key set to value.
+func ContextWithHeader(ctx context.Context, key string, value string) context.Context {
+	headers := Headers{key: value}
+	for k, v := range HeadersFromContext(ctx) {
+		if k != key {
+			headers[k] = v
+		}
+	}
+	return ContextWithHeaders(ctx, headers)
+}
+
+// HeadersFromContext returns the headers carried by ctx, such as those of the
+// job a worker's handler is running for. The headers must not be modified.
+func HeadersFromContext(ctx context.Context) Headers {
+	headers, _ := ctx.Value(headersKey{}).(Headers)
+	return headers
+}
+
+// envelopePrefix returns what comes before a body put with ctx, or nil if the
+// client doesn't use envelopes.
+func (jackd *Client) envelopePrefix(ctx context.Context) []byte {
+	if !jackd.envelopes {
+		return nil
+	}
+
+	headers := Headers{}
+	for key, value := range HeadersFromContext(ctx) {
+		headers[key] = value
+	}
+	headers[HeaderEnqueuedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	return envelopePrefix(headers)
+}
+
+// wrap puts body in an envelope with the headers of ctx, if the client uses
+// envelopes.
+func (jackd *Client) wrap(ctx context.Context, body []byte) []byte {
+	if !jackd.envelopes {
+		return body
+	}
+	return append(jackd.envelopePrefix(ctx), body...)
+}
+
+// unwrap takes a job's body and headers out of its envelope, if the client
+// uses envelopes. A body that isn't a valid envelope is left as is.
+func (jackd *Client) unwrap(job *Job) {
+	if !jackd.envelopes {
+		return
+	}
+
+	headers, body, err := DecodeEnvelope(job.Body)
+	if err != nil {
+		return
+	}
+	job.Headers = headers
+	job.Body = body
+}
+
+// Context returns a copy of ctx carrying the job's headers, so that the jobs
+// put with it carry them along.
+func (job *Job) Context(ctx context.Context) context.Context {
+	if job.Headers == nil {
+		return ctx
+	}
+	return ContextWithHeaders(ctx, job.Headers)
+}
@@ -1,12 +1,19 @@
 package jackd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"strings"
 )
 
 var NoErrs = make([]string, 0)
 var TubeNameTooBig = errors.New("tube name over 200 bytes")
+var ErrClosed = errors.New("client is closed")
+var ErrBodySize = errors.New("job body does not match its declared size")
 
 func validateTubeName(tube string) error {
 	tubeNameBytes := []byte(tube)
@@ -25,17 +32,182 @@ func validate(resp string, additionalErrorStrings []string) error {
 
 	for _, errorString := range errorStrings {
 		if strings.HasPrefix(resp, errorString) {
-			if err, ok := errorMap[errorString]; ok {
-				return err
+			err, ok := errorMap[errorString]
+			if !ok {
+				err = errors.New(errorString)
 			}
 
-			return errors.New(errorString)
+			return &ProtocolError{Response: resp, Err: err}
 		}
 	}
 
 	return nil
 }
 
+// ProtocolError is returned when the server answers a command with an error.
+// It wraps the error for the response, such as ErrNotFound, so that
+// errors.Is(err, ErrNotFound) holds.
+type ProtocolError struct {
+	// Command is the name of the command, such as "delete".
+	Command string
+	// JobID and Tube are the job and tube the command was about, if any.
+	JobID uint32
+	Tube  string
+	// Response is the response line, without its CRLF.
+	Response string
+	Err      error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Command == "" {
+		return e.Err.Error()
+	}
+
+	command := e.Command
+	if e.JobID != 0 {
+		command += fmt.Sprintf(" job %d", e.JobID)
+	}
+	if e.Tube != "" {
+		command += fmt.Sprintf(" (tube %s)", e.Tube)
+	}
+	return command + ": " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// UnexpectedResponseError is returned when the server's response to a command
+// makes no sense for that command.
+type UnexpectedResponseError struct {
+	Command  string
+	Response string
+}
+
+func (e *UnexpectedResponseError) Error() string {
+	if e.Command == "" {
+		return "unexpected response: " + e.Response
+	}
+	return fmt.Sprintf("unexpected response to %s: %s", e.Command, e.Response)
+}
+
+var unexpectedResponseError = func(resp string) error {
+	return &UnexpectedResponseError{Response: resp}
+}
+
+// BuriedError is the ErrBuried of put and release: the server ran out of
+// memory for its priority queue and buried the job instead. ID is the buried
+// job.
+type BuriedError struct {
+	ID uint32
+}
+
+func (e *BuriedError) Error() string {
+	return ErrBuried.Error()
+}
+
+func (e *BuriedError) Is(target error) bool {
+	return target == ErrBuried
+}
+
+// IsConnectionError reports whether err comes from the connection to the
+// server rather than from the server itself. The client can't be used anymore
+// after such an error, and returns ErrClosed from then on unless it
+// reconnects. Errors wrapping ErrOutcomeUnknown are connection errors too.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// context.DeadlineExceeded looks like a net.Error, but it is the caller's
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrClosed) ||
+		errors.Is(err, ErrOutcomeUnknown) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsProtocolError reports whether err is an error response from the server,
+// or a response that makes no sense.
+func IsProtocolError(err error) bool {
+	var protocolErr *ProtocolError
+	var unexpectedErr *UnexpectedResponseError
+	return errors.As(err, &protocolErr) || errors.As(err, &unexpectedErr)
+}
+
+// IsTemporary reports whether err means the server can't carry out commands
+// for the time being: it is out of memory, draining, or failed internally.
+// Backing off before trying again is in order.
+func IsTemporary(err error) bool {
+	return errors.Is(err, ErrOutOfMemory) ||
+		errors.Is(err, ErrDraining) ||
+		errors.Is(err, ErrInternalError)
+}
+
+// IsRetryable reports whether the command that failed with err may succeed if
+// run again: the server is temporarily unavailable, a reserve found no job in
+// time or a reserved job is about to time out, or the connection failed. After
+// a connection error, a client that doesn't reconnect has to be replaced
+// first, and a command whose outcome is unknown may run twice.
+//
+// Errors such as ErrNotFound or ErrJobTooBig are not retryable, and neither is
+// ErrBuried: the job was created.
+func IsRetryable(err error) bool {
+	return IsTemporary(err) ||
+		IsConnectionError(err) ||
+		errors.Is(err, ErrTimedOut) ||
+		errors.Is(err, ErrDeadlineSoon)
+}
+
+// describe records which command, job and tube an error from the server's
+// response relates to.
+func describe(err error, command string, id uint32, tube string) error {
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) {
+		protocolErr.Command = command
+		protocolErr.JobID = id
+		protocolErr.Tube = tube
+	}
+
+	var unexpectedErr *UnexpectedResponseError
+	if errors.As(err, &unexpectedErr) {
+		unexpectedErr.Command = command
+	}
+
+	return err
+}
+
+// describeCommand returns the name and arguments of the command on line, and
+// the job or tube it is about.
+func describeCommand(line []byte) (name string, args []string, id uint32, tube string) {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return "", nil, 0, ""
+	}
+	name, args = fields[0], fields[1:]
+	if len(args) == 0 {
+		return name, args, 0, ""
+	}
+
+	switch name {
+	case "use", "watch", "ignore", "pause-tube", "stats-tube":
+		tube = fields[1]
+	case "delete", "release", "bury", "touch", "kick-job", "peek", "reserve-job", "stats-job":
+		if n, err := strconv.ParseUint(fields[1], 10, 32); err == nil {
+			id = uint32(n)
+		}
+	}
+	return name, args, id, tube
+}
+
 //goland:noinspection ALL
 var (
 	/* Generic command errors */
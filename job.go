@@ -0,0 +1,281 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrJobFinalized = errors.New("job already deleted, released or buried")
+
+// Job is a job returned by one of the reserve or peek commands, bound to the
+// client it came from.
+type Job struct {
+	ID   uint32
+	Body []byte
+	// Tube is the tube the job came from, or empty if the client can't tell
+	// without asking the server. Stats reports it in either case.
+	Tube string
+	// ReservedAt is when the job was reserved, or zero for peeked jobs.
+	ReservedAt time.Time
+	// TTR is the job's time-to-run, or zero if unknown. beanstalkd doesn't
+	// send it along with the job, but Stats reports it.
+	TTR time.Duration
+	// Headers are the headers the job was put with, for clients using
+	// envelopes. They are nil if the job wasn't put in an envelope.
+	Headers Headers
+
+	client *Client
+
+	mutex     sync.Mutex
+	finalized bool
+}
+
+func (job *Job) Delete() error {
+	return job.DeleteContext(context.Background())
+}
+
+func (job *Job) DeleteContext(ctx context.Context) error {
+	return job.finalize(func() error {
+		return job.client.DeleteContext(ctx, job.ID)
+	})
+}
+
+func (job *Job) Release(opts ReleaseOpts) error {
+	return job.ReleaseContext(context.Background(), opts)
+}
+
+func (job *Job) ReleaseContext(ctx context.Context, opts ReleaseOpts) error {
+	return job.finalize(func() error {
+		return job.client.ReleaseContext(ctx, job.ID, opts)
+	})
+}
+
+func (job *Job) Bury(priority uint32) error {
+	return job.BuryContext(context.Background(), priority)
+}
+
+func (job *Job) BuryContext(ctx context.Context, priority uint32) error {
+	return job.finalize(func() error {
+		return job.client.BuryContext(ctx, job.ID, priority)
+	})
+}
+
+func (job *Job) Touch() error {
+	return job.TouchContext(context.Background())
+}
+
+func (job *Job) TouchContext(ctx context.Context) error {
+	// Hold the mutex so that a touch can't land after the job is finalized
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.finalized {
+		return ErrJobFinalized
+	}
+
+	return job.client.TouchContext(ctx, job.ID)
+}
+
+// KeepAlive touches the job in the background each time half of its
+// time-to-run has passed, so that it stays reserved while it takes longer
+// than that to process. If the job's TTR isn't known, it is looked up first.
+//
+// It stops when ctx is done, when the job is finalized or when the returned
+// function is called, which waits for any touch underway. If a touch fails,
+// onFailed is called if set, and the job is no longer kept alive. A failure
+// with ErrNotFound means the job was lost, for instance because its TTR ran
+// out before the touch.
+func (job *Job) KeepAlive(ctx context.Context, onFailed func(job *Job, err error)) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if err := job.keepAlive(ctx); err != nil && onFailed != nil {
+			onFailed(job, err)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// keepAlive touches the job until ctx is done or the job is finalized, and
+// returns the error of a failed touch. Commands are sent with a background
+// context, since interrupting one would close the connection and lose the job.
+func (job *Job) keepAlive(ctx context.Context) error {
+	ttr := job.TTR
+	next := ttr / 2
+	if !job.ReservedAt.IsZero() {
+		next -= time.Since(job.ReservedAt)
+	}
+
+	if ttr == 0 {
+		stats, err := job.client.JobStats(job.ID)
+		if err != nil {
+			return err
+		}
+		ttr = stats.TTR
+		next = stats.TimeLeft / 2
+	}
+
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err := job.Touch(); err != nil {
+			if errors.Is(err, ErrJobFinalized) {
+				return nil
+			}
+			return err
+		}
+		timer.Reset(ttr / 2)
+	}
+}
+
+func (job *Job) Stats() (*JobStats, error) {
+	return job.StatsContext(context.Background())
+}
+
+func (job *Job) StatsContext(ctx context.Context) (*JobStats, error) {
+	return job.client.JobStatsContext(ctx, job.ID)
+}
+
+// Finalized reports whether the job has been deleted, released or buried
+// through this value.
+func (job *Job) Finalized() bool {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.finalized
+}
+
+// finalize runs fn unless the job was already finalized, and marks the job as
+// finalized if fn succeeds. Concurrent callers are serialized so that only one
+// of them can act on the job.
+func (job *Job) finalize(fn func() error) error {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.finalized {
+		return ErrJobFinalized
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	job.finalized = true
+	return nil
+}
+
+func (jackd *Client) ReserveNextJob() (*Job, error) {
+	return jackd.ReserveNextJobContext(context.Background())
+}
+
+func (jackd *Client) ReserveNextJobContext(ctx context.Context) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte("reserve\r\n"), "RESERVED", []string{DeadlineSoon, TimedOut}, jackd.reservedFromWatched)
+}
+
+func (jackd *Client) ReserveNextJobWithTimeout(timeout time.Duration) (*Job, error) {
+	return jackd.ReserveNextJobWithTimeoutContext(context.Background(), timeout)
+}
+
+func (jackd *Client) ReserveNextJobWithTimeoutContext(ctx context.Context, timeout time.Duration) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte(fmt.Sprintf(
+		"reserve-with-timeout %d\r\n",
+		timeoutSeconds(timeout),
+	)), "RESERVED", []string{DeadlineSoon, TimedOut}, jackd.reservedFromWatched)
+}
+
+// ReserveJobByID is ReserveJob returning a *Job.
+func (jackd *Client) ReserveJobByID(id uint32) (*Job, error) {
+	return jackd.ReserveJobByIDContext(context.Background(), id)
+}
+
+func (jackd *Client) ReserveJobByIDContext(ctx context.Context, id uint32) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte(fmt.Sprintf("reserve-job %d\r\n", id)), "RESERVED", []string{DeadlineSoon, TimedOut}, reservedByID)
+}
+
+func (jackd *Client) PeekJob(id uint32) (*Job, error) {
+	return jackd.PeekJobContext(context.Background(), id)
+}
+
+func (jackd *Client) PeekJobContext(ctx context.Context, id uint32) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte(fmt.Sprintf("peek %d\r\n", id)), "FOUND", []string{NotFound}, nil)
+}
+
+func (jackd *Client) PeekReadyJob() (*Job, error) {
+	return jackd.PeekReadyJobContext(context.Background())
+}
+
+func (jackd *Client) PeekReadyJobContext(ctx context.Context) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte("peek-ready\r\n"), "FOUND", []string{NotFound}, jackd.peekedFromUsed)
+}
+
+func (jackd *Client) PeekDelayedJob() (*Job, error) {
+	return jackd.PeekDelayedJobContext(context.Background())
+}
+
+func (jackd *Client) PeekDelayedJobContext(ctx context.Context) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte("peek-delayed\r\n"), "FOUND", []string{NotFound}, jackd.peekedFromUsed)
+}
+
+func (jackd *Client) PeekBuriedJob() (*Job, error) {
+	return jackd.PeekBuriedJobContext(context.Background())
+}
+
+func (jackd *Client) PeekBuriedJobContext(ctx context.Context) (*Job, error) {
+	return jackd.jobCommand(ctx, []byte("peek-buried\r\n"), "FOUND", []string{NotFound}, jackd.peekedFromUsed)
+}
+
+// jobCommand sends a command that responds with a job and wraps the response
+// in a *Job. If set, annotate is called with the connection still held to fill
+// in what the client knows about where the job came from.
+func (jackd *Client) jobCommand(ctx context.Context, command []byte, expected string, errs []string, annotate func(*Job)) (job *Job, err error) {
+	err = jackd.command(ctx, command, func() error {
+		id, body, err := jackd.responseJobChunk(expected, errs)
+		if err != nil {
+			return err
+		}
+
+		job = &Job{ID: id, Body: body, client: jackd}
+		jackd.unwrap(job)
+		if annotate != nil {
+			annotate(job)
+		}
+		return nil
+	})
+	return
+}
+
+// reservedFromWatched annotates a job reserved from the watched tubes. The tube
+// is only known when a single tube is watched.
+func (jackd *Client) reservedFromWatched(job *Job) {
+	job.ReservedAt = time.Now()
+	if len(jackd.watching) == 1 {
+		job.Tube = jackd.watching[0]
+	}
+}
+
+func reservedByID(job *Job) {
+	job.ReservedAt = time.Now()
+}
+
+// peekedFromUsed annotates a job found by peek-ready, peek-delayed or
+// peek-buried, which only look in the tube in use.
+func (jackd *Client) peekedFromUsed(job *Job) {
+	job.Tube = jackd.tube
+}
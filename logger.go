@@ -0,0 +1,51 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Logger receives the client's log records as a message followed by key-value
+// pairs, which is how *slog.Logger works.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+func (jackd *Client) logCommand(op *operation, took time.Duration, err error) {
+	if jackd.logger == nil {
+		return
+	}
+
+	args := []interface{}{"command", op.name}
+	if op.job != 0 {
+		args = append(args, "job", op.job)
+	}
+	if op.tube != "" {
+		args = append(args, "tube", op.tube)
+	}
+	args = append(args, "duration", took)
+	if jackd.logPayloads && op.body != nil {
+		args = append(args, "body", string(op.body))
+	}
+
+	if err == nil {
+		jackd.logger.Debug("command done", args...)
+		return
+	}
+	args = append(args, "error", err)
+
+	var protocolErr *ProtocolError
+	switch {
+	case errors.As(err, &protocolErr):
+		args = append(args, "response", protocolErr.Response)
+		jackd.logger.Info("error response", args...)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		jackd.logger.Debug("command cancelled", args...)
+	default:
+		jackd.logger.Warn("command failed", args...)
+	}
+}
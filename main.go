@@ -3,485 +3,1175 @@ package jackd
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var Delimiter = []byte("\r\n")
 var MaxTubeName = 200
 
-func Dial(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+func Dial(addr string, opts ...Option) (*Client, error) {
+	return DialContext(context.Background(), addr, opts...)
+}
+
+// DialContext connects to beanstalkd at addr. ctx only bounds the time it
+// takes to connect.
+func DialContext(ctx context.Context, addr string, opts ...Option) (*Client, error) {
+	options := newOptions(opts)
+
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return dialConn(ctx, addr, options)
+	}
+
+	conn, err := dial(ctx)
 	if err != nil {
+		if options.logger != nil {
+			options.logger.Error("connecting failed", "addr", addr, "error", err)
+		}
 		return nil, err
 	}
 
-	reader := bufio.NewReader(conn)
-	scanner := bufio.NewScanner(reader)
-	scanner.Split(splitCRLF)
+	jackd := newClient(conn, options)
+	jackd.dial = dial
+	if jackd.logger != nil {
+		jackd.logger.Info("connected", "addr", addr)
+	}
+	return jackd, nil
+}
 
-	return &Client{
-		conn: conn,
-		buffer: bufio.NewReadWriter(
-			reader,
-			bufio.NewWriter(conn),
-		),
-		scanner: scanner,
-		mutex:   new(sync.Mutex),
-	}, nil
+func dialConn(ctx context.Context, addr string, options *options) (net.Conn, error) {
+	if options.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.connectTimeout)
+		defer cancel()
+	}
+
+	dialer := net.Dialer{KeepAlive: options.keepAlive}
+	conn, err := dialer.DialContext(ctx, options.network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.tlsConfig != nil {
+		config := options.tlsConfig
+		if config.ServerName == "" && options.network != "unix" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			config = config.Clone()
+			config.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return conn, nil
 }
 
-func (jackd *Client) Put(body []byte, opts PutOpts) (uint32, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+// NewClient runs the beanstalkd protocol over an existing connection, such as
+// one end of a net.Pipe or a tunneled channel. The options that concern
+// dialing are ignored. If conn supports deadlines like a net.Conn does,
+// cancelled contexts and WithIOTimeout interrupt pending commands through
+// them. Otherwise a cancelled context can only close conn, and WithIOTimeout
+// has no effect. A client made this way can't reconnect.
+func NewClient(conn io.ReadWriteCloser, opts ...Option) *Client {
+	return newClient(conn, newOptions(opts))
+}
 
-	command := []byte(fmt.Sprintf(
-		"put %d %d %d %d\r\n",
-		opts.Priority,
-		uint(opts.Delay.Seconds()),
-		uint(opts.TTR.Seconds()),
-		len(body)),
+func newClient(conn io.ReadWriteCloser, options *options) *Client {
+	jackd := &Client{
+		lock:        make(chan struct{}, 1),
+		pipelined:   options.pipelined,
+		ioTimeout:   options.ioTimeout,
+		backoff:     options.backoff,
+		envelopes:   options.envelopes,
+		logger:      options.logger,
+		metrics:     options.metrics,
+		observer:    options.observer,
+		logPayloads: options.logPayloads,
+		tube:        "default",
+		watching:    []string{"default"},
+	}
+	jackd.setConn(conn)
+	return jackd
+}
+
+// setConn puts the client to work on conn.
+func (jackd *Client) setConn(conn io.ReadWriteCloser) {
+	turn := make(chan struct{})
+	close(turn)
+
+	jackd.conn = conn
+	jackd.transport = &transport{conn: conn, metrics: jackd.metrics}
+	jackd.buffer = bufio.NewReadWriter(
+		bufio.NewReader(jackd.transport),
+		bufio.NewWriter(jackd.transport),
 	)
+	jackd.turn = turn
+}
+
+func (jackd *Client) Put(body []byte, opts PutOpts) (uint32, error) {
+	return jackd.PutContext(context.Background(), body, opts)
+}
+
+func (jackd *Client) PutContext(ctx context.Context, body []byte, opts PutOpts) (id uint32, err error) {
+	op := &operation{name: "put", body: body}
+	body = jackd.wrap(ctx, body)
+	op.args = putArgs(opts, int64(len(body)))
+
+	err = jackd.exec(ctx, op, func() error {
+		if err := jackd.writePut(body, opts); err != nil {
+			return err
+		}
+		return jackd.buffer.Flush()
+	}, func() error {
+		id, err = jackd.putResponse(jackd.tube)
+		return err
+	})
+	return
+}
+
+// putArgs are the arguments of a put command for a body of size bytes.
+func putArgs(opts PutOpts, size int64) []string {
+	return []string{
+		strconv.FormatUint(uint64(opts.Priority), 10),
+		strconv.FormatUint(uint64(opts.Delay.Seconds()), 10),
+		strconv.FormatUint(uint64(opts.TTR.Seconds()), 10),
+		strconv.FormatInt(size, 10),
+	}
+}
+
+func putLine(args []string) []byte {
+	return []byte("put " + strings.Join(args, " ") + "\r\n")
+}
+
+// writePut buffers a put command without flushing it.
+func (jackd *Client) writePut(body []byte, opts PutOpts) error {
+	command := putLine(putArgs(opts, int64(len(body))))
 
 	// Write the command
 	if _, err := jackd.buffer.Write(command); err != nil {
-		return 0, err
+		return err
 	}
 	// Write the body
 	if _, err := jackd.buffer.Write(body); err != nil {
-		return 0, err
+		return err
 	}
 	// Write the delimiter
-	if _, err := jackd.buffer.Write(Delimiter); err != nil {
-		return 0, err
-	}
-	// Flush the writer
-	if err := jackd.buffer.Flush(); err != nil {
-		return 0, err
+	_, err := jackd.buffer.Write(Delimiter)
+	return err
+}
+
+func (jackd *Client) PutReader(r io.Reader, size int64, opts PutOpts) (uint32, error) {
+	return jackd.PutReaderContext(context.Background(), r, size, opts)
+}
+
+// PutReaderContext puts a job whose body is streamed from r instead of being
+// held in memory. r must yield exactly size bytes followed by io.EOF, or
+// ErrBodySize is returned and no job is created.
+func (jackd *Client) PutReaderContext(ctx context.Context, r io.Reader, size int64, opts PutOpts) (id uint32, err error) {
+	if size < 0 {
+		return 0, ErrBodySize
 	}
 
-	for jackd.scanner.Scan() {
-		resp := string(jackd.scanner.Bytes())
-		if err := validate(resp, []string{
-			Buried,
-			ExpectedCRLF,
-			JobTooBig,
-			Draining,
-		}); err != nil {
-			return 0, err
+	// Set when r turns out not to hold size bytes
+	var readErr error
+
+	prefix := jackd.envelopePrefix(ctx)
+	op := &operation{name: "put", args: putArgs(opts, int64(len(prefix))+size)}
+	err = jackd.exec(ctx, op, func() error {
+		if _, err := jackd.buffer.Write(putLine(op.args)); err != nil {
+			return err
+		}
+		if _, err := jackd.buffer.Write(prefix); err != nil {
+			return err
 		}
 
-		var id uint32 = 0
+		var written int64
+		written, readErr = io.CopyN(jackd.buffer, r, size)
+		if readErr == nil {
+			// Anything left in r means the declared size was wrong
+			var extra [1]byte
+			if n, _ := io.ReadFull(r, extra[:]); n > 0 {
+				readErr = ErrBodySize
+			}
+		}
 
-		_, err := fmt.Sscanf(resp, "INSERTED %d", &id)
-		if err != nil {
-			_, err = fmt.Sscanf(resp, "BURIED %d", &id)
-			if err != nil {
-				return id, ErrBuried
+		if readErr == nil {
+			if _, err := jackd.buffer.Write(Delimiter); err != nil {
+				return err
 			}
+			return jackd.buffer.Flush()
 		}
 
-		return id, nil
+		if readErr == io.EOF {
+			readErr = ErrBodySize
+		}
+
+		// The server is waiting for the rest of the body. Pad it out and end
+		// it with something other than a CRLF: the server then discards the
+		// job with EXPECTED_CRLF and the connection stays usable.
+		if _, err := io.CopyN(jackd.buffer, zeroes{}, size-written); err != nil {
+			return err
+		}
+		if _, err := jackd.buffer.Write([]byte("\x00\x00")); err != nil {
+			return err
+		}
+		return jackd.buffer.Flush()
+	}, func() error {
+		id, err = jackd.putResponse(jackd.tube)
+		if readErr != nil {
+			if err != nil && !errors.Is(err, ErrExpectedCRLF) {
+				return err
+			}
+			return readErr
+		}
+		return err
+	})
+	return
+}
+
+// putResponse reads the response to a put into tube.
+func (jackd *Client) putResponse(tube string) (uint32, error) {
+	resp, err := jackd.readLine()
+	if err != nil {
+		return 0, err
 	}
 
-	return 0, jackd.scanner.Err()
+	id, err := parsePutResponse(resp)
+	jackd.record(id, tube, nil)
+	return id, err
 }
 
-func (jackd *Client) Use(tube string) (usingTube string, err error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+// parsePutResponse returns the id of the new job. A job that was buried still
+// has an id, which is returned along with a *BuriedError.
+func parsePutResponse(resp string) (id uint32, err error) {
+	if _, err := fmt.Sscanf(resp, "BURIED %d", &id); err == nil {
+		return id, &ProtocolError{Response: resp, Err: &BuriedError{ID: id}}
+	}
 
-	if err = validateTubeName(tube); err != nil {
-		return
+	if err := validate(resp, []string{
+		Buried,
+		ExpectedCRLF,
+		JobTooBig,
+		Draining,
+	}); err != nil {
+		return 0, err
 	}
 
-	if err = jackd.write([]byte(fmt.Sprintf("use %s\r\n", tube))); err != nil {
+	if _, err := fmt.Sscanf(resp, "INSERTED %d", &id); err != nil {
+		return 0, unexpectedResponseError(resp)
+	}
+
+	return id, nil
+}
+
+type zeroes struct{}
+
+func (zeroes) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (jackd *Client) Use(tube string) (string, error) {
+	return jackd.UseContext(context.Background(), tube)
+}
+
+func (jackd *Client) UseContext(ctx context.Context, tube string) (usingTube string, err error) {
+	if err = validateTubeName(tube); err != nil {
 		return
 	}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err = validate(resp, NoErrs); err != nil {
-			return
+	err = jackd.command(ctx, []byte(fmt.Sprintf("use %s\r\n", tube)), func() error {
+		resp, err := jackd.readLine()
+		if err != nil {
+			return err
 		}
 
-		_, err = fmt.Sscanf(resp, "USING %s", &usingTube)
-		if err != nil {
-			return
+		if err := validate(resp, NoErrs); err != nil {
+			return err
 		}
-	}
 
-	err = jackd.scanner.Err()
+		if _, err := fmt.Sscanf(resp, "USING %s", &usingTube); err != nil {
+			return unexpectedResponseError(resp)
+		}
+		jackd.tube = usingTube
+
+		return nil
+	})
 	return
 }
 
-func (jackd *Client) Kick(numJobs uint32) (kicked uint32, err error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+func (jackd *Client) Kick(numJobs uint32) (uint32, error) {
+	return jackd.KickContext(context.Background(), numJobs)
+}
 
-	if err = jackd.write([]byte(fmt.Sprintf("kick %d\r\n", numJobs))); err != nil {
-		return
-	}
+func (jackd *Client) KickContext(ctx context.Context, numJobs uint32) (kicked uint32, err error) {
+	err = jackd.command(ctx, []byte(fmt.Sprintf("kick %d\r\n", numJobs)), func() error {
+		resp, err := jackd.readLine()
+		if err != nil {
+			return err
+		}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err = validate(resp, NoErrs); err != nil {
-			return
+		if err := validate(resp, NoErrs); err != nil {
+			return err
 		}
 
-		_, err = fmt.Sscanf(resp, "KICKED %d", &kicked)
-		if err != nil {
-			return
+		if _, err := fmt.Sscanf(resp, "KICKED %d", &kicked); err != nil {
+			return unexpectedResponseError(resp)
 		}
-	}
 
-	err = jackd.scanner.Err()
+		return nil
+	})
 	return
 }
 
 func (jackd *Client) KickJob(id uint32) error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte(fmt.Sprintf("kick-job %d\r\n", id))); err != nil {
-		return err
-	}
+	return jackd.KickJobContext(context.Background(), id)
+}
 
-	return jackd.expectedResponse("KICKED", []string{NotFound})
+func (jackd *Client) KickJobContext(ctx context.Context, id uint32) error {
+	return jackd.command(ctx, []byte(fmt.Sprintf("kick-job %d\r\n", id)), func() error {
+		return jackd.expectedResponse("KICKED", []string{NotFound})
+	})
 }
 
 func (jackd *Client) Delete(job uint32) error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte(fmt.Sprintf("delete %d\r\n", job))); err != nil {
-		return err
-	}
+	return jackd.DeleteContext(context.Background(), job)
+}
 
-	return jackd.expectedResponse("DELETED", []string{NotFound})
+func (jackd *Client) DeleteContext(ctx context.Context, job uint32) error {
+	return jackd.command(ctx, []byte(fmt.Sprintf("delete %d\r\n", job)), func() error {
+		return jackd.expectedResponse("DELETED", []string{NotFound})
+	})
 }
 
 func (jackd *Client) PauseTube(tube string, delay time.Duration) error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+	return jackd.PauseTubeContext(context.Background(), tube, delay)
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf(
+func (jackd *Client) PauseTubeContext(ctx context.Context, tube string, delay time.Duration) error {
+	return jackd.command(ctx, []byte(fmt.Sprintf(
 		"pause-tube %s %d\r\n",
 		tube,
 		uint32(delay.Seconds()),
-	))); err != nil {
-		return err
-	}
-
-	return jackd.expectedResponse("PAUSED", []string{NotFound})
+	)), func() error {
+		return jackd.expectedResponse("PAUSED", []string{NotFound})
+	})
 }
 
 func (jackd *Client) Release(job uint32, opts ReleaseOpts) error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+	return jackd.ReleaseContext(context.Background(), job, opts)
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf(
+func (jackd *Client) ReleaseContext(ctx context.Context, job uint32, opts ReleaseOpts) error {
+	return jackd.command(ctx, []byte(fmt.Sprintf(
 		"release %d %d %d\r\n",
 		job,
 		opts.Priority,
 		uint32(opts.Delay.Seconds()),
-	))); err != nil {
-		return err
-	}
+	)), func() error {
+		err := jackd.expectedResponse("RELEASED", []string{Buried, NotFound})
 
-	return jackd.expectedResponse("RELEASED", []string{Buried, NotFound})
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) && protocolErr.Err == ErrBuried {
+			protocolErr.Err = &BuriedError{ID: job}
+		}
+		return err
+	})
 }
 
 func (jackd *Client) Bury(job uint32, priority uint32) error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+	return jackd.BuryContext(context.Background(), job, priority)
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf(
+func (jackd *Client) BuryContext(ctx context.Context, job uint32, priority uint32) error {
+	return jackd.command(ctx, []byte(fmt.Sprintf(
 		"bury %d %d\r\n",
 		job,
 		priority,
-	))); err != nil {
-		return err
-	}
-
-	return jackd.expectedResponse("BURIED", []string{NotFound})
+	)), func() error {
+		return jackd.expectedResponse("BURIED", []string{NotFound})
+	})
 }
 
 func (jackd *Client) Touch(job uint32) error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte(fmt.Sprintf("touch %d\r\n", job))); err != nil {
-		return err
-	}
+	return jackd.TouchContext(context.Background(), job)
+}
 
-	return jackd.expectedResponse("TOUCHED", []string{NotFound})
+func (jackd *Client) TouchContext(ctx context.Context, job uint32) error {
+	return jackd.command(ctx, []byte(fmt.Sprintf("touch %d\r\n", job)), func() error {
+		return jackd.expectedResponse("TOUCHED", []string{NotFound})
+	})
 }
 
-func (jackd *Client) Watch(tube string) (watched uint32, err error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+func (jackd *Client) Watch(tube string) (uint32, error) {
+	return jackd.WatchContext(context.Background(), tube)
+}
 
+func (jackd *Client) WatchContext(ctx context.Context, tube string) (watched uint32, err error) {
 	if err = validateTubeName(tube); err != nil {
 		return
 	}
 
-	if err = jackd.write([]byte(fmt.Sprintf("watch %s\r\n", tube))); err != nil {
-		return
-	}
+	err = jackd.command(ctx, []byte(fmt.Sprintf("watch %s\r\n", tube)), func() error {
+		resp, err := jackd.readLine()
+		if err != nil {
+			return err
+		}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err = validate(resp, NoErrs); err != nil {
-			return
+		if err := validate(resp, NoErrs); err != nil {
+			return err
 		}
 
-		_, err = fmt.Sscanf(resp, "WATCHING %d", &watched)
-		if err != nil {
-			return
+		if _, err := fmt.Sscanf(resp, "WATCHING %d", &watched); err != nil {
+			return unexpectedResponseError(resp)
 		}
-	}
+		jackd.watch(tube)
 
-	err = jackd.scanner.Err()
+		return nil
+	})
 	return
 }
 
-func (jackd *Client) Ignore(tube string) (watched uint32, err error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+func (jackd *Client) Ignore(tube string) (uint32, error) {
+	return jackd.IgnoreContext(context.Background(), tube)
+}
 
+func (jackd *Client) IgnoreContext(ctx context.Context, tube string) (watched uint32, err error) {
 	if err = validateTubeName(tube); err != nil {
 		return
 	}
 
-	if err = jackd.write([]byte(fmt.Sprintf("ignore %s\r\n", tube))); err != nil {
-		return
-	}
+	err = jackd.command(ctx, []byte(fmt.Sprintf("ignore %s\r\n", tube)), func() error {
+		resp, err := jackd.readLine()
+		if err != nil {
+			return err
+		}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err = validate(resp, []string{NotIgnored}); err != nil {
-			return
+		if err := validate(resp, []string{NotIgnored}); err != nil {
+			return err
 		}
 
-		_, err = fmt.Sscanf(resp, "WATCHING %d", &watched)
-		if err != nil {
-			return
+		if _, err := fmt.Sscanf(resp, "WATCHING %d", &watched); err != nil {
+			return unexpectedResponseError(resp)
 		}
-	}
+		jackd.ignore(tube)
 
-	err = jackd.scanner.Err()
+		return nil
+	})
 	return
 }
 
 func (jackd *Client) Reserve() (uint32, []byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+	return jackd.ReserveContext(context.Background())
+}
 
-	if err := jackd.write([]byte("reserve\r\n")); err != nil {
-		return 0, nil, err
-	}
+func (jackd *Client) ReserveContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte("reserve\r\n"), func() error {
+		id, body, err = jackd.responseJobChunk("RESERVED", []string{DeadlineSoon, TimedOut})
+		return err
+	})
+	return
+}
 
-	return jackd.responseJobChunk("RESERVED", []string{DeadlineSoon, TimedOut})
+func (jackd *Client) ReserveWithTimeout(timeout time.Duration) (uint32, []byte, error) {
+	return jackd.ReserveWithTimeoutContext(context.Background(), timeout)
 }
 
-func (jackd *Client) ReserveJob(job uint32) (uint32, []byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+// ReserveWithTimeoutContext waits at most timeout for a job to become
+// available, returning ErrTimedOut if none does. beanstalkd only accepts whole
+// seconds, so the timeout is rounded up; a timeout of 0 polls without blocking.
+func (jackd *Client) ReserveWithTimeoutContext(ctx context.Context, timeout time.Duration) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte(fmt.Sprintf(
+		"reserve-with-timeout %d\r\n",
+		timeoutSeconds(timeout),
+	)), func() error {
+		id, body, err = jackd.responseJobChunk("RESERVED", []string{DeadlineSoon, TimedOut})
+		return err
+	})
+	return
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf("reserve-job %d\r\n", job))); err != nil {
-		return 0, nil, err
-	}
+func (jackd *Client) ReserveTo(w io.Writer) (uint32, int64, error) {
+	return jackd.ReserveToContext(context.Background(), w)
+}
 
-	return jackd.responseJobChunk("RESERVED", []string{DeadlineSoon, TimedOut})
+// ReserveToContext reserves a job and copies its body to w as it arrives from
+// the connection, without holding it in memory. It returns the job id and the
+// number of bytes written to w. If w fails, the rest of the body is discarded,
+// the job stays reserved and the error from w is returned along with the id.
+// A reconnecting client doesn't reserve again once part of the body reached w,
+// and returns ErrOutcomeUnknown instead.
+func (jackd *Client) ReserveToContext(ctx context.Context, w io.Writer) (id uint32, n int64, err error) {
+	err = jackd.commandTo(ctx, []byte("reserve\r\n"), func() error {
+		id, n, err = jackd.responseJobChunkTo(w, "RESERVED", []string{DeadlineSoon, TimedOut})
+		return err
+	}, func() bool { return n > 0 })
+	return
+}
+
+func (jackd *Client) ReserveJob(job uint32) (uint32, []byte, error) {
+	return jackd.ReserveJobContext(context.Background(), job)
+}
+
+func (jackd *Client) ReserveJobContext(ctx context.Context, job uint32) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte(fmt.Sprintf("reserve-job %d\r\n", job)), func() error {
+		id, body, err = jackd.responseJobChunk("RESERVED", []string{DeadlineSoon, TimedOut})
+		return err
+	})
+	return
 }
 
 func (jackd *Client) Peek(job uint32) (uint32, []byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+	return jackd.PeekContext(context.Background(), job)
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf("peek %d\r\n", job))); err != nil {
-		return 0, nil, err
-	}
+func (jackd *Client) PeekContext(ctx context.Context, job uint32) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte(fmt.Sprintf("peek %d\r\n", job)), func() error {
+		id, body, err = jackd.responseJobChunk("FOUND", []string{NotFound})
+		return err
+	})
+	return
+}
 
-	return jackd.responseJobChunk("FOUND", []string{NotFound})
+func (jackd *Client) PeekTo(job uint32, w io.Writer) (uint32, int64, error) {
+	return jackd.PeekToContext(context.Background(), job, w)
 }
 
-func (jackd *Client) PeekReady() (uint32, []byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+// PeekToContext is the peek counterpart of ReserveToContext.
+func (jackd *Client) PeekToContext(ctx context.Context, job uint32, w io.Writer) (id uint32, n int64, err error) {
+	err = jackd.commandTo(ctx, []byte(fmt.Sprintf("peek %d\r\n", job)), func() error {
+		id, n, err = jackd.responseJobChunkTo(w, "FOUND", []string{NotFound})
+		return err
+	}, func() bool { return n > 0 })
+	return
+}
 
-	if err := jackd.write([]byte("peek-ready\r\n")); err != nil {
-		return 0, nil, err
-	}
+func (jackd *Client) PeekReady() (uint32, []byte, error) {
+	return jackd.PeekReadyContext(context.Background())
+}
 
-	return jackd.responseJobChunk("FOUND", []string{NotFound})
+func (jackd *Client) PeekReadyContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte("peek-ready\r\n"), func() error {
+		id, body, err = jackd.responseJobChunk("FOUND", []string{NotFound})
+		return err
+	})
+	return
 }
 
 func (jackd *Client) PeekDelayed() (uint32, []byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte("peek-delayed\r\n")); err != nil {
-		return 0, nil, err
-	}
+	return jackd.PeekDelayedContext(context.Background())
+}
 
-	return jackd.responseJobChunk("FOUND", []string{NotFound})
+func (jackd *Client) PeekDelayedContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte("peek-delayed\r\n"), func() error {
+		id, body, err = jackd.responseJobChunk("FOUND", []string{NotFound})
+		return err
+	})
+	return
 }
 
 func (jackd *Client) PeekBuried() (uint32, []byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte("peek-buried\r\n")); err != nil {
-		return 0, nil, err
-	}
+	return jackd.PeekBuriedContext(context.Background())
+}
 
-	return jackd.responseJobChunk("FOUND", []string{NotFound})
+func (jackd *Client) PeekBuriedContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = jackd.command(ctx, []byte("peek-buried\r\n"), func() error {
+		id, body, err = jackd.responseJobChunk("FOUND", []string{NotFound})
+		return err
+	})
+	return
 }
 
 func (jackd *Client) StatsJob(id uint32) ([]byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte(fmt.Sprintf("stats-job %d\r\n", id))); err != nil {
-		return nil, err
-	}
+	return jackd.StatsJobContext(context.Background(), id)
+}
 
-	return jackd.responseDataChunk([]string{NotFound})
+func (jackd *Client) StatsJobContext(ctx context.Context, id uint32) (body []byte, err error) {
+	err = jackd.command(ctx, []byte(fmt.Sprintf("stats-job %d\r\n", id)), func() error {
+		body, err = jackd.responseDataChunk([]string{NotFound})
+		return err
+	})
+	return
 }
 
 func (jackd *Client) StatsTube(tubeName string) ([]byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
-
-	if err := jackd.write([]byte(fmt.Sprintf("stats-tube %s\r\n", tubeName))); err != nil {
-		return nil, err
-	}
+	return jackd.StatsTubeContext(context.Background(), tubeName)
+}
 
-	return jackd.responseDataChunk([]string{NotFound})
+func (jackd *Client) StatsTubeContext(ctx context.Context, tubeName string) (body []byte, err error) {
+	err = jackd.command(ctx, []byte(fmt.Sprintf("stats-tube %s\r\n", tubeName)), func() error {
+		body, err = jackd.responseDataChunk([]string{NotFound})
+		return err
+	})
+	return
 }
 
 func (jackd *Client) Stats() ([]byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+	return jackd.StatsContext(context.Background())
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf("stats\r\n"))); err != nil {
+func (jackd *Client) StatsContext(ctx context.Context) (body []byte, err error) {
+	err = jackd.command(ctx, []byte("stats\r\n"), func() error {
+		body, err = jackd.responseDataChunk([]string{NotFound})
+		return err
+	})
+	return
+}
+
+func (jackd *Client) ListTubes() ([]byte, error) {
+	return jackd.ListTubesContext(context.Background())
+}
+
+func (jackd *Client) ListTubesContext(ctx context.Context) (body []byte, err error) {
+	err = jackd.command(ctx, []byte("list-tubes\r\n"), func() error {
+		body, err = jackd.responseDataChunk([]string{NotFound})
+		return err
+	})
+	return
+}
+
+func (jackd *Client) Tubes() ([]string, error) {
+	return jackd.TubesContext(context.Background())
+}
+
+// TubesContext is ListTubesContext with the response parsed into tube names.
+func (jackd *Client) TubesContext(ctx context.Context) ([]string, error) {
+	body, err := jackd.ListTubesContext(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	return jackd.responseDataChunk([]string{NotFound})
+	return parseYAMLList(body)
 }
 
-func (jackd *Client) ListTubes() ([]byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+func (jackd *Client) ListTubeUsed() (string, error) {
+	return jackd.ListTubeUsedContext(context.Background())
+}
+
+func (jackd *Client) ListTubeUsedContext(ctx context.Context) (tube string, err error) {
+	err = jackd.command(ctx, []byte("list-tube-used\r\n"), func() error {
+		resp, err := jackd.readLine()
+		if err != nil {
+			return err
+		}
+
+		if err := validate(resp, NoErrs); err != nil {
+			return err
+		}
+
+		if _, err := fmt.Sscanf(resp, "USING %s", &tube); err != nil {
+			return unexpectedResponseError(resp)
+		}
+
+		return nil
+	})
+	return
+}
 
-	if err := jackd.write([]byte(fmt.Sprintf("list-tubes\r\n"))); err != nil {
+func (jackd *Client) ListTubesWatched() ([]byte, error) {
+	return jackd.ListTubesWatchedContext(context.Background())
+}
+
+func (jackd *Client) ListTubesWatchedContext(ctx context.Context) (body []byte, err error) {
+	err = jackd.command(ctx, []byte("list-tubes-watched\r\n"), func() error {
+		body, err = jackd.responseDataChunk([]string{NotFound})
+		return err
+	})
+	return
+}
+
+func (jackd *Client) TubesWatched() ([]string, error) {
+	return jackd.TubesWatchedContext(context.Background())
+}
+
+// TubesWatchedContext is ListTubesWatchedContext with the response parsed into
+// tube names.
+func (jackd *Client) TubesWatchedContext(ctx context.Context) ([]string, error) {
+	body, err := jackd.ListTubesWatchedContext(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	return jackd.responseDataChunk([]string{NotFound})
+	return parseYAMLList(body)
 }
 
-func (jackd *Client) ListTubeUsed() (tube string, err error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+func (jackd *Client) Quit() error {
+	// Don't let the client reconnect from now on
+	atomic.StoreInt32(&jackd.quit, 1)
+
+	return jackd.exec(context.Background(), &operation{name: "quit"}, func() error {
+		// Refuse any command issued after this one
+		atomic.StoreInt32(&jackd.closed, 1)
+		return jackd.write([]byte("quit\r\n"))
+	}, func() error {
+		if jackd.logger != nil {
+			jackd.logger.Info("disconnected")
+		}
+		return jackd.conn.Close()
+	})
+}
 
-	if err = jackd.write([]byte(fmt.Sprintf("list-tube-used\r\n"))); err != nil {
-		return
+// timeoutSeconds converts a reserve timeout to whole seconds, rounding up so
+// that a short but non-zero timeout still blocks. Negative timeouts poll, and
+// timeouts beyond what the protocol can express are capped.
+func timeoutSeconds(timeout time.Duration) uint32 {
+	seconds := math.Ceil(timeout.Seconds())
+	if seconds <= 0 {
+		return 0
 	}
+	if seconds >= math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(seconds)
+}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err = validate(resp, NoErrs); err != nil {
+func (jackd *Client) watch(tube string) {
+	for _, watched := range jackd.watching {
+		if watched == tube {
 			return
 		}
+	}
+	jackd.watching = append(jackd.watching, tube)
+}
 
-		_, err = fmt.Sscanf(resp, "USING %s", &tube)
-		if err != nil {
+func (jackd *Client) ignore(tube string) {
+	for i, watched := range jackd.watching {
+		if watched == tube {
+			jackd.watching = append(jackd.watching[:i:i], jackd.watching[i+1:]...)
 			return
 		}
 	}
+}
 
-	err = jackd.scanner.Err()
-	return
+// command runs a command consisting of a single line, whose response is
+// consumed by read.
+func (jackd *Client) command(ctx context.Context, line []byte, read func() error) error {
+	return jackd.commandTo(ctx, line, read, nil)
 }
 
-func (jackd *Client) ListTubesWatched() ([]byte, error) {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+// commandTo is command for the commands copying a job body to a writer as it
+// arrives. They are only run again if written reports that nothing reached the
+// writer yet, since the writer can't take back part of a body.
+func (jackd *Client) commandTo(ctx context.Context, line []byte, read func() error, written func() bool) error {
+	name, args, id, tube := describeCommand(line)
+	op := &operation{name: name, args: args, job: id, tube: tube, wait: responseWait(line)}
+	write := func() error {
+		return jackd.write(line)
+	}
 
-	if err := jackd.write([]byte(fmt.Sprintf("list-tubes-watched\r\n"))); err != nil {
-		return nil, err
+	err := jackd.exec(ctx, op, write, read)
+	if errors.Is(err, ErrOutcomeUnknown) && isIdempotent(line) && (written == nil || !written()) {
+		// Running the command again is harmless, and exec reconnects first
+		err = jackd.exec(ctx, op, write, read)
 	}
+	return err
+}
 
-	return jackd.responseDataChunk([]string{NotFound})
+// idempotentCommands are safe to run again when the connection was lost
+// before their response came in. Jobs reserved by a lost connection go back to
+// the ready queue, so the reserve commands are among them.
+var idempotentCommands = map[string]bool{
+	"use":                  true,
+	"watch":                true,
+	"ignore":               true,
+	"reserve":              true,
+	"reserve-with-timeout": true,
+	"reserve-job":          true,
+	"peek":                 true,
+	"peek-ready":           true,
+	"peek-delayed":         true,
+	"peek-buried":          true,
+	"stats":                true,
+	"stats-job":            true,
+	"stats-tube":           true,
+	"list-tubes":           true,
+	"list-tube-used":       true,
+	"list-tubes-watched":   true,
+	"pause-tube":           true,
 }
 
-func (jackd *Client) Quit() error {
-	jackd.mutex.Lock()
-	defer jackd.mutex.Unlock()
+func isIdempotent(line []byte) bool {
+	name := bytes.TrimSuffix(line, Delimiter)
+	if i := bytes.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
+	}
+	return idempotentCommands[string(name)]
+}
 
-	if err := jackd.write([]byte("quit\r\n")); err != nil {
-		return err
+// responseWait is how long the server may hold back its response to a command
+// on purpose: reserve-with-timeout waits up to its timeout for a job, and
+// reserve waits indefinitely, which is reported as a negative duration.
+func responseWait(line []byte) time.Duration {
+	if !bytes.HasPrefix(line, []byte("reserve")) {
+		return 0
+	}
+	if bytes.Equal(line, []byte("reserve\r\n")) {
+		return -1
 	}
 
-	return jackd.conn.Close()
+	var seconds uint32
+	if _, err := fmt.Sscanf(string(line), "reserve-with-timeout %d\r\n", &seconds); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
 }
 
-func (jackd *Client) expectedResponse(expected string, errs []string) error {
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err := validate(resp, errs); err != nil {
+// operation describes a command being run, for logging and metrics.
+type operation struct {
+	name string
+	args []string
+	// job and tube are what the command is about, if anything. They may only
+	// be known once the response is in, see record.
+	job  uint32
+	tube string
+	// body is the job body sent or received, if any.
+	body []byte
+	// wait is how long the server may hold back its response, see
+	// responseWait.
+	wait time.Duration
+	// drain holds the command back until the responses to the commands
+	// already sent are in, for commands depending on the session's state.
+	drain bool
+}
+
+// exec runs op and reports how it went, see run.
+func (jackd *Client) exec(ctx context.Context, op *operation, write func() error, read func() error) error {
+	if jackd.metrics != nil {
+		jackd.metrics.CommandStarted(op.name)
+	}
+	var info *CommandInfo
+	observed := ctx
+	if jackd.observer != nil {
+		info = &CommandInfo{Command: op.name, Args: op.args, Tube: op.tube, JobID: op.job}
+		observed = jackd.observer.BeforeCommand(ctx, info)
+	}
+
+	start := time.Now()
+	err := describe(jackd.run(ctx, op, write, read), op.name, op.job, op.tube)
+	took := time.Since(start)
+
+	jackd.logCommand(op, took, err)
+	if jackd.metrics != nil {
+		jackd.metrics.CommandFinished(op.name, outcome(op, err), took)
+	}
+	if jackd.observer != nil {
+		info.Tube, info.JobID = op.tube, op.job
+		info.Duration, info.Err = took, err
+		jackd.observer.AfterCommand(observed, info)
+	}
+	return err
+}
+
+// record notes the job and tube a response is about, and the job's body if
+// payloads are logged, for the operation whose response is being read.
+func (jackd *Client) record(id uint32, tube string, body []byte) {
+	op := jackd.current
+	if op == nil {
+		return
+	}
+	op.job = id
+	if tube != "" {
+		op.tube = tube
+	}
+	if body != nil && jackd.logPayloads {
+		op.body = body
+	}
+}
+
+// run runs a command in two phases: write sends the command and read
+// consumes its response. Normally the connection is held for both phases. In
+// pipelined mode it is handed to the next caller as soon as the command is
+// written, and since beanstalkd answers commands in order, each read phase
+// waits for the previous one to finish.
+//
+// If ctx is done before the command completes, the in-flight I/O is
+// interrupted and ctx.Err() is returned. A command interrupted halfway leaves
+// the connection in an unknown protocol state, so the connection is closed
+// and later calls fail with ErrClosed, or reconnect if the client was set up
+// to. The same goes for a command that runs out of I/O time, otherwise fails
+// on the connection, or gets a response that makes no sense; op.wait extends
+// the time allowed for the response, see responseWait.
+func (jackd *Client) run(ctx context.Context, op *operation, write func() error, read func() error) error {
+	select {
+	case jackd.lock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	locked := true
+	unlock := func() {
+		if locked {
+			locked = false
+			<-jackd.lock
+		}
+	}
+	defer unlock()
+
+	// The lock is let go while draining, so that a pending reserve doesn't
+	// hold everyone else back, and nothing is sent if ctx is done first
+	for op.drain && !isClosed(jackd.turn) {
+		pending := jackd.turn
+		unlock()
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case jackd.lock <- struct{}{}:
+			locked = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&jackd.closed) == 1 {
+		if err := jackd.reconnect(ctx); err != nil {
 			return err
 		}
+	}
 
-		if resp != expected {
-			return unexpectedResponseError(resp)
+	if conn, ok := jackd.conn.(deadlineConn); ok && jackd.ioTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(jackd.ioTimeout)); err != nil {
+			return err
 		}
 	}
 
-	return nil
-}
+	interrupted := jackd.interruptOnDone(ctx)
 
-func (jackd *Client) responseJobChunk(expected string, errs []string) (uint32, []byte, error) {
-	var id uint32 = 0
-	var payloadLength = 0
+	if err := write(); err != nil {
+		// A partially written command can't be taken back
+		jackd.close()
+		if interrupted() {
+			return ctx.Err()
+		}
+		return jackd.connectionLost(err)
+	}
+
+	previous := jackd.turn
+	turn := make(chan struct{})
+	jackd.turn = turn
+	if jackd.pipelined {
+		unlock()
+	}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err := validate(resp, errs); err != nil {
-			return 0, nil, err
+	select {
+	case <-previous:
+		if jackd.ioTimeout > 0 {
+			jackd.setReadDeadline(op.wait)
 		}
+	case <-ctx.Done():
+	}
+
+	// The read deadline must be set before checking ctx, or it could undo an
+	// interruption that has just happened.
+	if ctx.Err() != nil {
+		// Our response will never be read, so nothing after it can be either
+		jackd.close()
+		interrupted()
+		go func() {
+			<-previous
+			close(turn)
+		}()
+		return ctx.Err()
+	}
+
+	// The connection stays ours until turn is closed, so that it can't be
+	// replaced while this command is still using it.
+	defer close(turn)
 
-		parsed, err := fmt.Sscanf(resp, expected+" %d %d", &id, &payloadLength)
+	jackd.current = op
+	err := read()
+	jackd.current = nil
+
+	if interrupted() {
+		if err == nil {
+			// The command completed before the interruption took effect
+			err = jackd.clearDeadline()
+		}
 		if err != nil {
-			return 0, nil, err
+			jackd.close()
+			return ctx.Err()
 		}
-		if parsed != 2 {
-			return 0, nil, unexpectedResponseError(resp)
+	}
+
+	if jackd.transport.readErr != nil {
+		jackd.close()
+		return jackd.connectionLost(err)
+	}
+
+	var unexpectedErr *UnexpectedResponseError
+	if errors.As(err, &unexpectedErr) {
+		// There's no telling which response belongs to which command anymore
+		jackd.close()
+	}
+
+	return err
+}
+
+// isClosed reports whether ch is closed, without blocking.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionLost qualifies an error that broke the connection halfway through
+// a command. When the client reconnects, the caller is told that the command
+// may or may not have taken effect.
+func (jackd *Client) connectionLost(err error) error {
+	if jackd.logger != nil {
+		jackd.logger.Warn("connection lost", "error", err)
+	}
+	if jackd.backoff == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrOutcomeUnknown, err)
+}
+
+// setReadDeadline gives the server the I/O timeout plus wait to respond, or
+// all the time it needs if wait is negative.
+func (jackd *Client) setReadDeadline(wait time.Duration) {
+	conn, ok := jackd.conn.(deadlineConn)
+	if !ok {
+		return
+	}
+
+	var deadline time.Time
+	if wait >= 0 {
+		deadline = time.Now().Add(jackd.ioTimeout + wait)
+	}
+	// Failing to set a deadline means the connection is closed, which the
+	// read will report
+	_ = conn.SetReadDeadline(deadline)
+}
+
+// deadlineConn is implemented by connections that support deadlines, such as
+// net.Conn.
+type deadlineConn interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// interrupt aborts any pending I/O on the connection. Connections without
+// deadlines can only be closed.
+func (jackd *Client) interrupt() {
+	if conn, ok := jackd.conn.(deadlineConn); ok {
+		_ = conn.SetDeadline(time.Now())
+		return
+	}
+	jackd.close()
+}
+
+// clearDeadline undoes interrupt, if the connection survived it.
+func (jackd *Client) clearDeadline() error {
+	if conn, ok := jackd.conn.(deadlineConn); ok {
+		return conn.SetDeadline(time.Time{})
+	}
+	return ErrClosed
+}
+
+// interruptOnDone arranges for any pending I/O on the connection to be
+// interrupted once ctx is done. The returned function must be called exactly
+// once, when the command is over, and reports whether that happened.
+func (jackd *Client) interruptOnDone(ctx context.Context) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	finished := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			jackd.interrupt()
+			interrupted <- true
+		case <-finished:
+			interrupted <- false
 		}
+	}()
+
+	return func() bool {
+		close(finished)
+		return <-interrupted
 	}
+}
+
+// close marks the client's connection as unusable and closes it.
+func (jackd *Client) close() {
+	atomic.StoreInt32(&jackd.closed, 1)
+	jackd.conn.Close()
+}
 
-	if err := jackd.scanner.Err(); err != nil {
+func (jackd *Client) expectedResponse(expected string, errs []string) error {
+	resp, err := jackd.readLine()
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(resp, expected, errs)
+}
+
+func checkResponse(resp string, expected string, errs []string) error {
+	if err := validate(resp, errs); err != nil {
+		return err
+	}
+
+	if resp != expected {
+		return unexpectedResponseError(resp)
+	}
+
+	return nil
+}
+
+func (jackd *Client) responseJobChunk(expected string, errs []string) (uint32, []byte, error) {
+	resp, err := jackd.readLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := validate(resp, errs); err != nil {
 		return 0, nil, err
 	}
 
-	body := []byte("")
+	header, ok := parseChunkHeader(resp, expected, 2)
+	if !ok || header[0] > math.MaxUint32 {
+		return 0, nil, unexpectedResponseError(resp)
+	}
 
-	for jackd.scanner.Scan() {
-		body = append(body, jackd.scanner.Bytes()...)
-		if len(body) == payloadLength {
-			break
-		}
-		body = append(body, Delimiter...)
+	body, err := jackd.readBody(header[1])
+	if err != nil {
+		return 0, nil, err
 	}
+	jackd.record(uint32(header[0]), "", body)
 
-	return id, body, jackd.scanner.Err()
+	return uint32(header[0]), body, nil
 }
 
 func Must(client *Client, err error) *Client {
@@ -492,60 +1182,203 @@ func Must(client *Client, err error) *Client {
 	return client
 }
 
+func (jackd *Client) responseJobChunkTo(w io.Writer, expected string, errs []string) (uint32, int64, error) {
+	resp, err := jackd.readLine()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := validate(resp, errs); err != nil {
+		return 0, 0, err
+	}
+
+	header, ok := parseChunkHeader(resp, expected, 2)
+	if !ok || header[0] > math.MaxUint32 {
+		return 0, 0, unexpectedResponseError(resp)
+	}
+
+	jackd.record(uint32(header[0]), "", nil)
+	n, err := jackd.copyBody(w, header[1])
+	return uint32(header[0]), n, err
+}
+
 func (jackd *Client) responseDataChunk(errs []string) ([]byte, error) {
-	var payloadLength = 0
+	resp, err := jackd.readLine()
+	if err != nil {
+		return nil, err
+	}
 
-	if jackd.scanner.Scan() {
-		resp := jackd.scanner.Text()
-		if err := validate(resp, errs); err != nil {
-			return nil, err
-		}
+	if err := validate(resp, errs); err != nil {
+		return nil, err
+	}
 
-		parsed, err := fmt.Sscanf(resp, "OK %d", &payloadLength)
-		if err != nil {
-			return nil, err
-		}
-		if parsed != 1 {
-			return nil, unexpectedResponseError(resp)
+	header, ok := parseChunkHeader(resp, "OK", 1)
+	if !ok {
+		return nil, unexpectedResponseError(resp)
+	}
+
+	return jackd.readBody(header[0])
+}
+
+// readLine reads a single CRLF terminated response line, without the CRLF.
+func (jackd *Client) readLine() (string, error) {
+	line, err := jackd.buffer.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		return "", err
+	}
+
+	if !bytes.HasSuffix(line, Delimiter) {
+		return "", unexpectedResponseError(string(line))
+	}
+
+	return string(line[:len(line)-len(Delimiter)]), nil
+}
+
+// readBody reads a data chunk of exactly size bytes followed by a CRLF. Only
+// the size announced in the response header is trusted, so payloads may
+// contain CRLFs of their own and be as large as the server's max-job-size.
+func (jackd *Client) readBody(size uint64) ([]byte, error) {
+	body := make([]byte, size)
+	if _, err := io.ReadFull(jackd.buffer, body); err != nil {
+		return nil, unexpectedEOF(err)
 	}
 
-	if err := jackd.scanner.Err(); err != nil {
+	if err := jackd.readDelimiter(); err != nil {
 		return nil, err
 	}
 
-	body := []byte("")
+	return body, nil
+}
 
-	for jackd.scanner.Scan() {
-		body = append(body, jackd.scanner.Bytes()...)
-		if len(body) == payloadLength {
-			break
+// copyBody copies a data chunk of size bytes followed by a CRLF to w. If w
+// fails, the rest of the chunk is still consumed so that the connection stays
+// usable, and the error from w is returned.
+func (jackd *Client) copyBody(w io.Writer, size uint64) (int64, error) {
+	body := &io.LimitedReader{R: jackd.buffer, N: int64(size)}
+	sink := &recordingWriter{w: w}
+
+	n, err := io.Copy(sink, body)
+	if sink.err != nil {
+		if _, err := jackd.buffer.Discard(int(body.N)); err != nil {
+			return n, unexpectedEOF(err)
+		}
+		if err := jackd.readDelimiter(); err != nil {
+			return n, err
 		}
-		body = append(body, Delimiter...)
+		return n, sink.err
+	}
+	if err != nil {
+		return n, err
+	}
+	if body.N > 0 {
+		return n, io.ErrUnexpectedEOF
 	}
 
-	return body, jackd.scanner.Err()
+	return n, jackd.readDelimiter()
 }
 
-var unexpectedResponseError = func(resp string) error {
-	return fmt.Errorf("unexpected response: %s", resp)
+// transport sits between the buffers and the connection and remembers the
+// first error in each direction, telling failures of the connection apart from
+// errors reported by the server.
+type transport struct {
+	conn     io.ReadWriteCloser
+	readErr  error
+	writeErr error
+	// metrics, if set, counts the bytes going through.
+	metrics Metrics
 }
 
-// Tweaked version of https://stackoverflow.com/a/37531472/1603399 that doesn't drop data
-func splitCRLF(buf []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(buf) == 0 {
-		return 0, nil, nil
+func (t *transport) Read(p []byte) (int, error) {
+	n, err := t.conn.Read(p)
+	if err != nil && t.readErr == nil {
+		t.readErr = err
 	}
-	if i := bytes.Index(buf, Delimiter); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + 2, buf[0:i], nil
+	if n > 0 && t.metrics != nil {
+		t.metrics.BytesRead(n)
 	}
-	// If we're at EOF, we have a final, non-terminated line. Return it.
-	if atEOF {
-		return len(buf), buf, nil
+	return n, err
+}
+
+func (t *transport) Write(p []byte) (int, error) {
+	n, err := t.conn.Write(p)
+	if err != nil && t.writeErr == nil {
+		t.writeErr = err
+	}
+	if n > 0 && t.metrics != nil {
+		t.metrics.BytesWritten(n)
+	}
+	return n, err
+}
+
+// recordingWriter remembers the error returned by w, telling it apart from
+// errors reading from the connection.
+type recordingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if err != nil {
+		rw.err = err
+	}
+	return n, err
+}
+
+func (jackd *Client) readDelimiter() error {
+	delimiter, err := jackd.buffer.Peek(len(Delimiter))
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.Equal(delimiter, Delimiter) {
+		return unexpectedResponseError("data chunk not terminated by CRLF")
+	}
+
+	_, err = jackd.buffer.Discard(len(Delimiter))
+	return err
+}
+
+// maxJobSize is the largest max-job-size beanstalkd can be configured with.
+const maxJobSize = 1 << 30
+
+// parseChunkHeader parses the count numbers following the keyword in the
+// header of a response with a data chunk, such as "RESERVED <id> <bytes>" or
+// "OK <bytes>". The last number is the size of the chunk.
+func parseChunkHeader(resp string, keyword string, count int) (numbers [2]uint64, ok bool) {
+	if !strings.HasPrefix(resp, keyword) || !strings.HasPrefix(resp[len(keyword):], " ") {
+		return numbers, false
+	}
+
+	rest := resp[len(keyword)+1:]
+	for i := 0; i < count; i++ {
+		field := rest
+		if space := strings.IndexByte(rest, ' '); space >= 0 {
+			field, rest = rest[:space], rest[space+1:]
+		} else {
+			rest = ""
+		}
+		if (rest == "") != (i == count-1) {
+			return numbers, false
+		}
+
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return numbers, false
+		}
+		numbers[i] = n
+	}
+
+	return numbers, numbers[count-1] <= maxJobSize
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
-	// Request more data.
-	return 0, nil, nil
+	return err
 }
 
 func (jackd *Client) write(command []byte) error {
@@ -1,7 +1,25 @@
 package jackd_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,6 +27,8 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/getjackd/go-jackd"
+	"github.com/getjackd/go-jackd/metrics"
+	"github.com/getjackd/go-jackd/tracing"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -36,6 +56,8 @@ func (suite *JackdSuite) SetupTest() {
 func (suite *JackdSuite) TearDownTest() {
 	err := suite.beanstalkd.Quit()
 	require.NoError(suite.T(), err)
+	err = suite.beanstalkd2.Quit()
+	require.NoError(suite.T(), err)
 }
 
 func TestConnects(t *testing.T) {
@@ -228,6 +250,138 @@ func (suite *JackdSuite) TestHandlesMassiveJobs() {
 	assert.Equal(suite.T(), payload, reservedPayload)
 }
 
+func (suite *JackdSuite) TestHandlesJobsLargerThanALine() {
+	stats, err := suite.beanstalkd.ServerStats()
+	require.NoError(suite.T(), err)
+
+	// A single line payload bigger than bufio.Scanner's 64KB token limit
+	size := 1 << 20
+	if stats.MaxJobSize < uint64(size) {
+		suite.T().Skipf("beanstalkd max-job-size of %d is too small", stats.MaxJobSize)
+	}
+	payload := bytes.Repeat([]byte("a"), size)
+
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	reservedID, reservedPayload, err := suite.beanstalkd.Reserve()
+
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), id, reservedID)
+	assert.Equal(suite.T(), payload, reservedPayload)
+}
+
+func (suite *JackdSuite) TestPutReader() {
+	payload := []byte("test job\r\nstreamed from a reader")
+	id, err := suite.beanstalkd.PutReader(bytes.NewReader(payload), int64(len(payload)), jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	reservedID, reservedPayload, err := suite.beanstalkd.Reserve()
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), id, reservedID)
+	assert.Equal(suite.T(), payload, reservedPayload)
+}
+
+func (suite *JackdSuite) TestPutReaderSizeMismatch() {
+	_, err := suite.beanstalkd.Use("put-reader-tube")
+	require.NoError(suite.T(), err)
+
+	payload := []byte("test job")
+
+	_, err = suite.beanstalkd.PutReader(bytes.NewReader(payload), int64(len(payload)+1), jackd.DefaultPutOpts())
+	assert.ErrorIs(suite.T(), err, jackd.ErrBodySize)
+
+	_, err = suite.beanstalkd.PutReader(bytes.NewReader(payload), int64(len(payload)-1), jackd.DefaultPutOpts())
+	assert.ErrorIs(suite.T(), err, jackd.ErrBodySize)
+
+	// Neither attempt created a job, and the connection is still usable
+	_, _, err = suite.beanstalkd.PeekReady()
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+}
+
+func (suite *JackdSuite) TestPutReaderJobTooBig() {
+	stats, err := suite.beanstalkd.ServerStats()
+	require.NoError(suite.T(), err)
+
+	size := int64(stats.MaxJobSize) + 1
+	_, err = suite.beanstalkd.PutReader(bytes.NewReader(make([]byte, size)), size, jackd.DefaultPutOpts())
+	assert.ErrorIs(suite.T(), err, jackd.ErrJobTooBig)
+
+	tube, err := suite.beanstalkd.ListTubeUsed()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "default", tube)
+}
+
+func (suite *JackdSuite) TestReserveTo() {
+	payload := []byte("test job\r\nwith line breaks")
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	var reserved bytes.Buffer
+	reservedID, n, err := suite.beanstalkd.ReserveTo(&reserved)
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), id, reservedID)
+	assert.Equal(suite.T(), int64(len(payload)), n)
+	assert.Equal(suite.T(), payload, reserved.Bytes())
+}
+
+func (suite *JackdSuite) TestPeekTo() {
+	payload := []byte("test job")
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	var peeked bytes.Buffer
+	peekedID, n, err := suite.beanstalkd.PeekTo(id, &peeked)
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), id, peekedID)
+	assert.Equal(suite.T(), int64(len(payload)), n)
+	assert.Equal(suite.T(), payload, peeked.Bytes())
+
+	_, _, err = suite.beanstalkd.PeekTo(id+1000, &peeked)
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+}
+
+type failingWriter struct {
+	limit int
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errWriterFull
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func (suite *JackdSuite) TestReserveToFailingWriter() {
+	payload := bytes.Repeat([]byte("test job\r\n"), 1000)
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	reservedID, n, err := suite.beanstalkd.ReserveTo(&failingWriter{limit: 100})
+	assert.ErrorIs(suite.T(), err, errWriterFull)
+	assert.Equal(suite.T(), id, reservedID)
+	assert.Equal(suite.T(), int64(100), n)
+
+	// The rest of the body was consumed, so the connection is still in sync
+	peekedID, peekedPayload, err := suite.beanstalkd.Peek(id)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), id, peekedID)
+	assert.Equal(suite.T(), payload, peekedPayload)
+}
+
 func (suite *JackdSuite) TestUseTube() {
 	tube := "some-other-tube"
 	returnedTube, err := suite.beanstalkd.Use(tube)
@@ -280,6 +434,35 @@ func (suite *JackdSuite) TestListTubesWatched() {
 	assert.Len(suite.T(), tubes, 1)
 }
 
+func (suite *JackdSuite) TestTubes() {
+	tube := "some-other-tube"
+	_, err := suite.beanstalkd.Watch(tube)
+	require.NoError(suite.T(), err)
+
+	tubes, err := suite.beanstalkd2.Tubes()
+	require.NoError(suite.T(), err)
+
+	assert.Contains(suite.T(), tubes, "default")
+	assert.Contains(suite.T(), tubes, tube)
+}
+
+func (suite *JackdSuite) TestTubesWatched() {
+	// Tube names that a general purpose YAML parser would not read back as
+	// plain strings
+	tubes := []string{"a-b+c/d;e.f$g_h(i)", "123", "true"}
+	for _, tube := range tubes {
+		_, err := suite.beanstalkd.Watch(tube)
+		require.NoError(suite.T(), err)
+	}
+	_, err := suite.beanstalkd.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	watched, err := suite.beanstalkd.TubesWatched()
+	require.NoError(suite.T(), err)
+
+	assert.ElementsMatch(suite.T(), tubes, watched)
+}
+
 func (suite *JackdSuite) TestPutReserveJobDifferentTube() {
 	tube := "some-other-tube"
 	_, err := suite.beanstalkd.Use(tube)
@@ -336,11 +519,12 @@ func (suite *JackdSuite) TestPauseTube() {
 	pausedPayload := []byte("my awesome other tube job")
 	tube := "some-other-tube"
 
-	// Pause the other tube for five seconds
-	err := suite.beanstalkd.PauseTube(tube, 5*time.Second)
+	// Ask the second client to watch the other tube, which also ensures that
+	// the tube exists
+	_, err := suite.beanstalkd2.Watch(tube)
 	require.NoError(suite.T(), err)
-	// Ask the second client to watch this paused tube
-	_, err = suite.beanstalkd2.Watch(tube)
+	// Pause the other tube for five seconds
+	err = suite.beanstalkd.PauseTube(tube, 5*time.Second)
 	require.NoError(suite.T(), err)
 
 	// Put in a delayed job for one second in the default tube
@@ -366,3 +550,2025 @@ func (suite *JackdSuite) TestPauseTube() {
 	assert.Equal(suite.T(), job, reservedJob)
 	assert.Equal(suite.T(), payload, reservedPayload)
 }
+
+func (suite *JackdSuite) TestReserveContextDeadline() {
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(suite.T(), err)
+
+	_, err = client.Watch("context-tube")
+	require.NoError(suite.T(), err)
+	_, err = client.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, _, err = client.ReserveContext(ctx)
+	assert.ErrorIs(suite.T(), err, context.DeadlineExceeded)
+
+	// The interrupted reserve leaves the connection in an unknown state, so
+	// the client refuses to issue further commands on it.
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(suite.T(), err, jackd.ErrClosed)
+}
+
+func (suite *JackdSuite) TestCancelledContextKeepsConnection() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := suite.beanstalkd.PutContext(ctx, []byte("test job"), jackd.DefaultPutOpts())
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+
+	tube, err := suite.beanstalkd.ListTubeUsed()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "default", tube)
+}
+
+func (suite *JackdSuite) TestContextWhileWaitingForConnection() {
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(suite.T(), err)
+
+	_, err = client.Watch("context-tube")
+	require.NoError(suite.T(), err)
+	_, err = client.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	reserveCtx, cancelReserve := context.WithCancel(context.Background())
+	reserved := make(chan error)
+	go func() {
+		_, _, err := client.ReserveContext(reserveCtx)
+		reserved <- err
+	}()
+
+	// Give the reserve a moment to take hold of the connection
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ListTubeUsedContext(ctx)
+	assert.ErrorIs(suite.T(), err, context.DeadlineExceeded)
+
+	cancelReserve()
+	assert.ErrorIs(suite.T(), <-reserved, context.Canceled)
+}
+
+func (suite *JackdSuite) TestReserveWithTimeout() {
+	payload := []byte("test job")
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	reservedID, reservedPayload, err := suite.beanstalkd.ReserveWithTimeout(1 * time.Second)
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), id, reservedID)
+	assert.Equal(suite.T(), payload, reservedPayload)
+}
+
+func (suite *JackdSuite) TestReserveWithTimeoutTimesOut() {
+	_, err := suite.beanstalkd.Watch("empty-tube")
+	require.NoError(suite.T(), err)
+	_, err = suite.beanstalkd.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	start := time.Now()
+	_, _, err = suite.beanstalkd.ReserveWithTimeout(1 * time.Second)
+	assert.ErrorIs(suite.T(), err, jackd.ErrTimedOut)
+	assert.True(suite.T(), time.Since(start) >= 1*time.Second)
+
+	// A zero timeout polls the tube without blocking, and so does a negative
+	// one
+	start = time.Now()
+	_, _, err = suite.beanstalkd.ReserveWithTimeout(0)
+	assert.ErrorIs(suite.T(), err, jackd.ErrTimedOut)
+	_, _, err = suite.beanstalkd.ReserveWithTimeout(-2 * time.Second)
+	assert.ErrorIs(suite.T(), err, jackd.ErrTimedOut)
+	_, err = suite.beanstalkd.ReserveNextJobWithTimeout(-time.Hour)
+	assert.ErrorIs(suite.T(), err, jackd.ErrTimedOut)
+	assert.Less(suite.T(), time.Since(start), time.Second)
+}
+
+func TestReserveWithTimeoutCapsLongTimeouts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		lines <- string(buf[:n])
+		conn.Write([]byte("TIMED_OUT\r\n"))
+	}()
+
+	client, err := jackd.Dial(listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, _, err = client.ReserveWithTimeout(time.Duration(math.MaxInt64))
+	assert.ErrorIs(t, err, jackd.ErrTimedOut)
+	assert.Equal(t, "reserve-with-timeout 4294967295\r\n", <-lines)
+}
+
+func (suite *JackdSuite) TestReserveWithTimeoutDeadlineSoon() {
+	opts := jackd.DefaultPutOpts()
+	opts.TTR = 1 * time.Second
+	id, err := suite.beanstalkd.Put([]byte("test job"), opts)
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	_, _, err = suite.beanstalkd.ReserveJob(id)
+	require.NoError(suite.T(), err)
+
+	// A job with a one second TTR is immediately within the safety margin
+	_, _, err = suite.beanstalkd.ReserveWithTimeout(1 * time.Second)
+	assert.ErrorIs(suite.T(), err, jackd.ErrDeadlineSoon)
+}
+
+func (suite *JackdSuite) TestServerStats() {
+	id, err := suite.beanstalkd.Put([]byte("test job"), jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	stats, err := suite.beanstalkd.ServerStats()
+	require.NoError(suite.T(), err)
+
+	assert.NotEmpty(suite.T(), stats.Version)
+	assert.True(suite.T(), stats.CmdPut > 0)
+	assert.True(suite.T(), stats.CurrentJobsReady > 0)
+	assert.True(suite.T(), stats.CurrentConnections >= 2)
+	assert.True(suite.T(), stats.MaxJobSize > 0)
+	assert.False(suite.T(), stats.Draining)
+}
+
+func (suite *JackdSuite) TestTubeStats() {
+	tube := "stats-tube"
+	_, err := suite.beanstalkd.Use(tube)
+	require.NoError(suite.T(), err)
+
+	opts := jackd.DefaultPutOpts()
+	opts.Delay = 10 * time.Second
+	id, err := suite.beanstalkd.Put([]byte("test job"), opts)
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	err = suite.beanstalkd.PauseTube(tube, 30*time.Second)
+	require.NoError(suite.T(), err)
+
+	stats, err := suite.beanstalkd.TubeStats(tube)
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), tube, stats.Name)
+	assert.Equal(suite.T(), uint64(1), stats.CurrentJobsDelayed)
+	assert.Equal(suite.T(), uint64(1), stats.CurrentUsing)
+	assert.Equal(suite.T(), 30*time.Second, stats.Pause)
+	assert.True(suite.T(), stats.PauseTimeLeft > 0)
+
+	_, err = suite.beanstalkd.TubeStats("no-such-tube")
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+}
+
+func (suite *JackdSuite) TestJobStats() {
+	opts := jackd.DefaultPutOpts()
+	opts.Priority = 42
+	opts.TTR = 30 * time.Second
+	id, err := suite.beanstalkd.Put([]byte("test job"), opts)
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	_, _, err = suite.beanstalkd.ReserveJob(id)
+	require.NoError(suite.T(), err)
+
+	stats, err := suite.beanstalkd.JobStats(id)
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), id, stats.ID)
+	assert.Equal(suite.T(), "default", stats.Tube)
+	assert.Equal(suite.T(), jackd.JobStateReserved, stats.State)
+	assert.Equal(suite.T(), "reserved", stats.State.String())
+	assert.Equal(suite.T(), uint32(42), stats.Priority)
+	assert.Equal(suite.T(), 30*time.Second, stats.TTR)
+	assert.True(suite.T(), stats.TimeLeft > 0 && stats.TimeLeft <= 30*time.Second)
+	assert.Equal(suite.T(), uint32(1), stats.Reserves)
+
+	err = suite.beanstalkd.Bury(id, 0)
+	require.NoError(suite.T(), err)
+
+	stats, err = suite.beanstalkd.JobStats(id)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), jackd.JobStateBuried, stats.State)
+	assert.Equal(suite.T(), uint32(1), stats.Buries)
+}
+
+func (suite *JackdSuite) TestReserveNextJob() {
+	tube := "job-tube"
+	_, err := suite.beanstalkd.Use(tube)
+	require.NoError(suite.T(), err)
+	_, err = suite.beanstalkd.Watch(tube)
+	require.NoError(suite.T(), err)
+	_, err = suite.beanstalkd.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	payload := []byte("test job")
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	require.NoError(suite.T(), err)
+
+	job, err := suite.beanstalkd.ReserveNextJob()
+	require.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), id, job.ID)
+	assert.Equal(suite.T(), payload, job.Body)
+	assert.Equal(suite.T(), tube, job.Tube)
+	assert.False(suite.T(), job.ReservedAt.IsZero())
+
+	require.NoError(suite.T(), job.Touch())
+
+	stats, err := job.Stats()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), tube, stats.Tube)
+	assert.Equal(suite.T(), 60*time.Second, stats.TTR)
+
+	require.NoError(suite.T(), job.Delete())
+	assert.True(suite.T(), job.Finalized())
+
+	_, _, err = suite.beanstalkd.Peek(id)
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+}
+
+func (suite *JackdSuite) TestJobGuardsAgainstDoubleFinalization() {
+	id, err := suite.beanstalkd.Put([]byte("test job"), jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	job, err := suite.beanstalkd.ReserveJobByID(id)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", job.Tube)
+
+	require.NoError(suite.T(), job.Bury(0))
+
+	assert.ErrorIs(suite.T(), job.Release(jackd.DefaultReleaseOpts()), jackd.ErrJobFinalized)
+	assert.ErrorIs(suite.T(), job.Delete(), jackd.ErrJobFinalized)
+	assert.ErrorIs(suite.T(), job.Touch(), jackd.ErrJobFinalized)
+
+	buried, err := suite.beanstalkd.PeekBuriedJob()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), id, buried.ID)
+	assert.Equal(suite.T(), "default", buried.Tube)
+	assert.True(suite.T(), buried.ReservedAt.IsZero())
+}
+
+func (suite *JackdSuite) TestJobRelease() {
+	payload := []byte("test job")
+	id, err := suite.beanstalkd.Put(payload, jackd.DefaultPutOpts())
+	defer suite.beanstalkd.Delete(id)
+	require.NoError(suite.T(), err)
+
+	job, err := suite.beanstalkd.ReserveNextJobWithTimeout(1 * time.Second)
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), job.Release(jackd.DefaultReleaseOpts()))
+
+	peeked, err := suite.beanstalkd.PeekJob(id)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), payload, peeked.Body)
+
+	stats, err := peeked.Stats()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), jackd.JobStateReady, stats.State)
+	assert.Equal(suite.T(), uint32(1), stats.Releases)
+}
+
+func (suite *JackdSuite) TestPipelinedPuts() {
+	client, err := jackd.Dial("localhost:11300", jackd.WithPipelining())
+	require.NoError(suite.T(), err)
+	defer client.Quit()
+
+	_, err = client.Use("pipelined-tube")
+	require.NoError(suite.T(), err)
+
+	const count = 50
+	ids := make([]uint32, count)
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			var err error
+			ids[i], err = client.Put([]byte(fmt.Sprintf("job %d", i)), jackd.DefaultPutOpts())
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < count; i++ {
+		require.NoError(suite.T(), <-errs)
+	}
+
+	// Every caller must have been handed the response to its own command
+	for i, id := range ids {
+		_, body, err := client.Peek(id)
+		require.NoError(suite.T(), err)
+		assert.Equal(suite.T(), fmt.Sprintf("job %d", i), string(body))
+		require.NoError(suite.T(), client.Delete(id))
+	}
+}
+
+func (suite *JackdSuite) TestPipelinedCancelWhileWaitingForResponse() {
+	client, err := jackd.Dial("localhost:11300", jackd.WithPipelining())
+	require.NoError(suite.T(), err)
+
+	_, err = client.Watch("context-tube")
+	require.NoError(suite.T(), err)
+	_, err = client.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	reserved := make(chan error)
+	go func() {
+		_, _, err := client.Reserve()
+		reserved <- err
+	}()
+
+	// Give the reserve a moment to be sent
+	time.Sleep(50 * time.Millisecond)
+
+	// The command is sent right away, but its response is stuck behind the
+	// reserve's
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ListTubeUsedContext(ctx)
+	assert.ErrorIs(suite.T(), err, context.DeadlineExceeded)
+
+	// Abandoning a response closes the connection for everyone
+	assert.Error(suite.T(), <-reserved)
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(suite.T(), err, jackd.ErrClosed)
+}
+
+func (suite *JackdSuite) TestPutMany() {
+	stats, err := suite.beanstalkd.ServerStats()
+	require.NoError(suite.T(), err)
+
+	jobs := []jackd.PutJob{
+		{Body: []byte("first"), Opts: jackd.DefaultPutOpts()},
+		{Body: make([]byte, stats.MaxJobSize+1), Opts: jackd.DefaultPutOpts()},
+		{Body: []byte("third"), Opts: jackd.DefaultPutOpts()},
+	}
+
+	ids, err := suite.beanstalkd.PutMany(jobs)
+	defer suite.beanstalkd.DeleteMany([]uint32{ids[0], ids[2]})
+
+	// The rejected job doesn't stop the rest of the batch
+	var batchErr *jackd.BatchError
+	require.ErrorAs(suite.T(), err, &batchErr)
+	assert.ErrorIs(suite.T(), err, jackd.ErrJobTooBig)
+	assert.Equal(suite.T(), []int{1}, batchErr.Failed())
+	assert.Zero(suite.T(), ids[1])
+
+	for _, i := range []int{0, 2} {
+		_, body, err := suite.beanstalkd.Peek(ids[i])
+		require.NoError(suite.T(), err)
+		assert.Equal(suite.T(), jobs[i].Body, body)
+	}
+}
+
+func (suite *JackdSuite) TestPutManyLargeBatch() {
+	jobs := make([]jackd.PutJob, 2500)
+	for i := range jobs {
+		jobs[i] = jackd.PutJob{Body: []byte(fmt.Sprintf("job %d", i)), Opts: jackd.DefaultPutOpts()}
+	}
+
+	ids, err := suite.beanstalkd.PutMany(jobs)
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), ids, len(jobs))
+
+	_, body, err := suite.beanstalkd.Peek(ids[len(ids)-1])
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "job 2499", string(body))
+
+	require.NoError(suite.T(), suite.beanstalkd.DeleteMany(ids))
+	_, _, err = suite.beanstalkd.Peek(ids[0])
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+}
+
+func (suite *JackdSuite) TestDeleteMany() {
+	id, err := suite.beanstalkd.Put([]byte("test job"), jackd.DefaultPutOpts())
+	require.NoError(suite.T(), err)
+
+	err = suite.beanstalkd.DeleteMany([]uint32{id, id})
+
+	var batchErr *jackd.BatchError
+	require.ErrorAs(suite.T(), err, &batchErr)
+	assert.NoError(suite.T(), batchErr.Errors[0])
+	assert.ErrorIs(suite.T(), batchErr.Errors[1], jackd.ErrNotFound)
+}
+
+func (suite *JackdSuite) TestKickJobs() {
+	var ids []uint32
+	for i := 0; i < 3; i++ {
+		id, err := suite.beanstalkd.Put([]byte("test job"), jackd.DefaultPutOpts())
+		require.NoError(suite.T(), err)
+		defer suite.beanstalkd.Delete(id)
+
+		_, _, err = suite.beanstalkd.ReserveJob(id)
+		require.NoError(suite.T(), err)
+		require.NoError(suite.T(), suite.beanstalkd.Bury(id, 0))
+		ids = append(ids, id)
+	}
+
+	require.NoError(suite.T(), suite.beanstalkd.KickJobs(ids))
+
+	for _, id := range ids {
+		stats, err := suite.beanstalkd.JobStats(id)
+		require.NoError(suite.T(), err)
+		assert.Equal(suite.T(), jackd.JobStateReady, stats.State)
+	}
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "jackd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "beanstalkd.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	serveOn(t, listener, []byte("USING default\r\n"))
+
+	client, err := jackd.Dial(socket, jackd.WithNetwork("unix"))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	tube, err := client.ListTubeUsed()
+	require.NoError(t, err)
+	assert.Equal(t, "default", tube)
+}
+
+func TestDialTLS(t *testing.T) {
+	// Borrow httptest's self-signed certificate
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+	require.NoError(t, err)
+	serveOn(t, listener, []byte("USING default\r\n"))
+
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig
+	client, err := jackd.Dial(
+		listener.Addr().String(),
+		jackd.WithTLS(config),
+		jackd.WithConnectTimeout(5*time.Second),
+		jackd.WithKeepAlive(30*time.Second),
+	)
+	require.NoError(t, err)
+	defer client.Quit()
+
+	tube, err := client.ListTubeUsed()
+	require.NoError(t, err)
+	assert.Equal(t, "default", tube)
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := jackd.DialContext(ctx, "localhost:11300")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestIOTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveOn(t, listener, nil)
+
+	client, err := jackd.Dial(listener.Addr().String(), jackd.WithIOTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = client.ListTubeUsed()
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	// The response may still arrive, so the connection can't be trusted
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+}
+
+func (suite *JackdSuite) TestIOTimeoutLeavesRoomForReserve() {
+	client, err := jackd.Dial("localhost:11300", jackd.WithIOTimeout(100*time.Millisecond))
+	require.NoError(suite.T(), err)
+	defer client.Quit()
+
+	_, err = client.Watch("io-timeout-tube")
+	require.NoError(suite.T(), err)
+	_, err = client.Ignore("default")
+	require.NoError(suite.T(), err)
+
+	_, _, err = client.ReserveWithTimeout(1 * time.Second)
+	assert.ErrorIs(suite.T(), err, jackd.ErrTimedOut)
+
+	tube, err := client.ListTubeUsed()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "default", tube)
+}
+
+func TestNewClientOverPipe(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go serveConn(serverConn, []byte("USING default\r\n"))
+
+	client := jackd.NewClient(clientConn, jackd.WithPipelining())
+	defer client.Quit()
+
+	tube, err := client.ListTubeUsed()
+	require.NoError(t, err)
+	assert.Equal(t, "default", tube)
+}
+
+// withoutDeadlines hides the deadline methods of a net.Conn.
+type withoutDeadlines struct {
+	io.ReadWriteCloser
+}
+
+func TestNewClientCancelWithoutDeadlines(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go serveConn(serverConn, nil)
+
+	client := jackd.NewClient(withoutDeadlines{clientConn})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := client.ReserveContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+}
+
+// proxy forwards connections to beanstalkd and can cut them, as if beanstalkd
+// had restarted.
+type proxy struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+	conns []net.Conn
+	// cutOn, if set, cuts a connection as soon as its client sends it
+	cutOn string
+}
+
+func newProxy(t *testing.T) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	p := &proxy{listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		p.cut()
+	})
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", "localhost:11300")
+			if err != nil {
+				client.Close()
+				continue
+			}
+
+			p.mutex.Lock()
+			p.conns = append(p.conns, client, server)
+			p.mutex.Unlock()
+
+			go io.Copy(client, server)
+			go p.forward(server, client)
+		}
+	}()
+
+	return p
+}
+
+func (p *proxy) forward(server net.Conn, client net.Conn) {
+	defer server.Close()
+	defer client.Close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			return
+		}
+
+		p.mutex.Lock()
+		cut := p.cutOn != "" && bytes.Contains(buf[:n], []byte(p.cutOn))
+		p.mutex.Unlock()
+		if cut {
+			return
+		}
+
+		if _, err := server.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (p *proxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) cut() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *proxy) cutWhenSent(command string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.cutOn = command
+}
+
+func reconnecting() jackd.Option {
+	return jackd.WithReconnect(jackd.ConstantBackoff{Delay: 10 * time.Millisecond, MaxAttempts: 10})
+}
+
+func TestReconnectRestoresSession(t *testing.T) {
+	p := newProxy(t)
+	client, err := jackd.Dial(p.addr(), reconnecting())
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Use("reconnect-tube")
+	require.NoError(t, err)
+	_, err = client.Watch("reconnect-tube")
+	require.NoError(t, err)
+	_, err = client.Ignore("default")
+	require.NoError(t, err)
+
+	p.cut()
+
+	tube, err := client.ListTubeUsed()
+	require.NoError(t, err)
+	assert.Equal(t, "reconnect-tube", tube)
+
+	watched, err := client.TubesWatched()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reconnect-tube"}, watched)
+}
+
+func TestReconnectPutOutcomeUnknown(t *testing.T) {
+	p := newProxy(t)
+	client, err := jackd.Dial(p.addr(), reconnecting())
+	require.NoError(t, err)
+	defer client.Quit()
+
+	p.cutWhenSent("put ")
+	_, err = client.Put([]byte("test job"), jackd.DefaultPutOpts())
+	assert.ErrorIs(t, err, jackd.ErrOutcomeUnknown)
+
+	// The next command goes through on a new connection
+	p.cutWhenSent("")
+	id, err := client.Put([]byte("test job"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	require.NoError(t, client.Delete(id))
+}
+
+func TestReconnectReserveToPartialBody(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var reserves int32
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, first bool) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line != "reserve\r\n" {
+						return
+					}
+					atomic.AddInt32(&reserves, 1)
+					if first {
+						// The connection drops halfway through the body
+						conn.Write([]byte("RESERVED 1 10\r\nhello"))
+						return
+					}
+					conn.Write([]byte("RESERVED 2 5\r\nworld\r\n"))
+				}
+			}(conn, first)
+		}
+	}()
+
+	client, err := jackd.Dial(listener.Addr().String(), reconnecting())
+	require.NoError(t, err)
+	defer client.Quit()
+
+	var reserved bytes.Buffer
+	_, n, err := client.ReserveTo(&reserved)
+	assert.ErrorIs(t, err, jackd.ErrOutcomeUnknown)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "hello", reserved.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reserves))
+
+	// The next reserve goes through on a new connection
+	reserved.Reset()
+	id, n, err := client.ReserveTo(&reserved)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), id)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "world", reserved.String())
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	p := newProxy(t)
+	client, err := jackd.Dial(p.addr(), jackd.WithReconnect(jackd.ConstantBackoff{MaxAttempts: 2}))
+	require.NoError(t, err)
+
+	p.listener.Close()
+	p.cut()
+
+	_, err = client.ListTubeUsed()
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, jackd.ErrOutcomeUnknown)
+}
+
+func TestNoReconnectWithoutOption(t *testing.T) {
+	p := newProxy(t)
+	client, err := jackd.Dial(p.addr())
+	require.NoError(t, err)
+
+	p.cut()
+
+	_, err = client.ListTubeUsed()
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, jackd.ErrOutcomeUnknown)
+
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+}
+
+func TestNoReconnectAfterQuit(t *testing.T) {
+	client, err := jackd.Dial("localhost:11300", reconnecting())
+	require.NoError(t, err)
+	require.NoError(t, client.Quit())
+
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := jackd.ExponentialBackoff{
+		Initial:     100 * time.Millisecond,
+		Max:         time.Second,
+		MaxAttempts: 10,
+	}
+
+	for failures, expected := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		9: time.Second,
+	} {
+		delay, ok := backoff.Next(failures)
+		assert.True(t, ok)
+		assert.Equal(t, expected, delay)
+	}
+
+	_, ok := backoff.Next(10)
+	assert.False(t, ok)
+}
+
+func TestPool(t *testing.T) {
+	pool := jackd.NewPool("localhost:11300", jackd.PoolOpts{MaxOpen: 3, MaxIdle: 2})
+	defer pool.Close()
+	tube := pool.WithTube("pool-tube")
+
+	const count = 20
+	ids := make(chan uint32, count)
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			id, err := tube.Put([]byte("test job"), jackd.DefaultPutOpts())
+			ids <- id
+			errs <- err
+		}()
+	}
+	for i := 0; i < count; i++ {
+		require.NoError(t, <-errs)
+		id := <-ids
+
+		stats, err := pool.JobStats(id)
+		require.NoError(t, err)
+		assert.Equal(t, "pool-tube", stats.Tube)
+		require.NoError(t, pool.Delete(id))
+	}
+
+	open, idle := pool.Connections()
+	assert.LessOrEqual(t, open, 2)
+	assert.Equal(t, open, idle)
+}
+
+func TestPoolEvictsIdleConnections(t *testing.T) {
+	pool := jackd.NewPool("localhost:11300", jackd.PoolOpts{MaxIdle: 2, IdleTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+
+	_, err := pool.Tubes()
+	require.NoError(t, err)
+	open, idle := pool.Connections()
+	assert.Equal(t, 1, open)
+	assert.Equal(t, 1, idle)
+
+	time.Sleep(200 * time.Millisecond)
+	open, idle = pool.Connections()
+	assert.Equal(t, 0, open)
+	assert.Equal(t, 0, idle)
+}
+
+func TestPoolTinyIdleTimeout(t *testing.T) {
+	pool := jackd.NewPool("localhost:11300", jackd.PoolOpts{MaxIdle: 1, IdleTimeout: time.Nanosecond})
+	defer pool.Close()
+
+	_, err := pool.Tubes()
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	open, idle := pool.Connections()
+	assert.Equal(t, 0, open)
+	assert.Equal(t, 0, idle)
+}
+
+func TestPoolReplacesBrokenConnections(t *testing.T) {
+	p := newProxy(t)
+	pool := jackd.NewPool(p.addr(), jackd.PoolOpts{MaxIdle: 1})
+	defer pool.Close()
+
+	_, err := pool.Tubes()
+	require.NoError(t, err)
+
+	// The idle connection fails its health check and a new one is opened
+	p.cut()
+	_, err = pool.Tubes()
+	require.NoError(t, err)
+
+	open, _ := pool.Connections()
+	assert.Equal(t, 1, open)
+}
+
+func TestPoolClosed(t *testing.T) {
+	pool := jackd.NewPool("localhost:11300", jackd.DefaultPoolOpts())
+	require.NoError(t, pool.Close())
+
+	_, err := pool.Put([]byte("test job"), jackd.DefaultPutOpts())
+	assert.ErrorIs(t, err, jackd.ErrPoolClosed)
+}
+
+func workerOpts(tube string) jackd.WorkerOpts {
+	opts := jackd.DefaultWorkerOpts()
+	opts.Tubes = []string{tube}
+	opts.Concurrency = 2
+	return opts
+}
+
+func putTo(t *testing.T, tube string, bodies ...string) []uint32 {
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Use(tube)
+	require.NoError(t, err)
+
+	var ids []uint32
+	for _, body := range bodies {
+		id, err := client.Put([]byte(body), jackd.DefaultPutOpts())
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestWorker(t *testing.T) {
+	ids := putTo(t, "worker-tube", "one", "two", "three", "four")
+
+	processed := make(chan string, len(ids))
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		assert.Equal(t, "worker-tube", job.Tube)
+		processed <- string(job.Body)
+		return nil
+	}, workerOpts("worker-tube"))
+	require.NoError(t, worker.Start(context.Background()))
+
+	var bodies []string
+	for range ids {
+		bodies = append(bodies, <-processed)
+	}
+	require.NoError(t, worker.Stop(context.Background()))
+	assert.ElementsMatch(t, []string{"one", "two", "three", "four"}, bodies)
+
+	// Jobs are deleted once handled
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer client.Quit()
+	for _, id := range ids {
+		_, _, err := client.Peek(id)
+		assert.ErrorIs(t, err, jackd.ErrNotFound)
+	}
+}
+
+func TestWorkerSettlesFailedJobs(t *testing.T) {
+	for name, test := range map[string]struct {
+		buryOnError bool
+		handler     jackd.Handler
+		state       jackd.JobState
+	}{
+		"release on error": {false, func(ctx context.Context, job *jackd.Job) error {
+			return errors.New("failed")
+		}, jackd.JobStateDelayed},
+		"bury on error": {true, func(ctx context.Context, job *jackd.Job) error {
+			return errors.New("failed")
+		}, jackd.JobStateBuried},
+		"release on panic": {false, func(ctx context.Context, job *jackd.Job) error {
+			panic("oops")
+		}, jackd.JobStateDelayed},
+	} {
+		t.Run(name, func(t *testing.T) {
+			id := putTo(t, "worker-failing-tube", "test job")[0]
+
+			handled := make(chan error, 1)
+			opts := workerOpts("worker-failing-tube")
+			opts.BuryOnError = test.buryOnError
+			opts.OnError = func(job *jackd.Job, err error) {
+				require.NotNil(t, job)
+				handled <- err
+			}
+
+			worker := jackd.NewWorker("localhost:11300", test.handler, opts)
+			require.NoError(t, worker.Start(context.Background()))
+			err := <-handled
+			require.NoError(t, worker.Stop(context.Background()))
+			assert.Error(t, err)
+
+			client, err := jackd.Dial("localhost:11300")
+			require.NoError(t, err)
+			defer client.Quit()
+			defer client.Delete(id)
+
+			stats, err := client.JobStats(id)
+			require.NoError(t, err)
+			assert.Equal(t, test.state, stats.State)
+		})
+	}
+}
+
+func TestWorkerStopTimesOut(t *testing.T) {
+	id := putTo(t, "worker-slow-tube", "test job")[0]
+
+	started := make(chan struct{})
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, workerOpts("worker-slow-tube"))
+	require.NoError(t, worker.Start(context.Background()))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, worker.Stop(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, worker.Stop(context.Background()), jackd.ErrWorkerNotRunning)
+
+	// The interrupted job was released
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer client.Quit()
+	defer client.Delete(id)
+
+	stats, err := client.JobStats(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), stats.Releases)
+}
+
+func (suite *JackdSuite) TestJobKeepAlive() {
+	opts := jackd.DefaultPutOpts()
+	opts.TTR = time.Second
+	id, err := suite.beanstalkd.Put([]byte("test job"), opts)
+	require.NoError(suite.T(), err)
+	defer suite.beanstalkd.Delete(id)
+
+	job, err := suite.beanstalkd.ReserveJobByID(id)
+	require.NoError(suite.T(), err)
+
+	stop := job.KeepAlive(context.Background(), func(job *jackd.Job, err error) {
+		suite.T().Errorf("touch failed: %v", err)
+	})
+	time.Sleep(1500 * time.Millisecond)
+	stop()
+
+	stats, err := job.Stats()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), jackd.JobStateReserved, stats.State)
+	assert.Equal(suite.T(), uint32(0), stats.Timeouts)
+	require.NoError(suite.T(), job.Delete())
+}
+
+func (suite *JackdSuite) TestJobKeepAliveReportsLostJob() {
+	opts := jackd.DefaultPutOpts()
+	opts.TTR = time.Second
+	id, err := suite.beanstalkd.Put([]byte("test job"), opts)
+	require.NoError(suite.T(), err)
+
+	job, err := suite.beanstalkd.ReserveNextJob()
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), id, job.ID)
+
+	failed := make(chan error, 1)
+	stop := job.KeepAlive(context.Background(), func(job *jackd.Job, err error) {
+		failed <- err
+	})
+	defer stop()
+
+	// Deleting the job behind the Job value's back makes the next touch fail
+	require.NoError(suite.T(), suite.beanstalkd.Delete(id))
+	assert.ErrorIs(suite.T(), <-failed, jackd.ErrNotFound)
+}
+
+func TestWorkerKeepsSlowJobsAlive(t *testing.T) {
+	opts := jackd.DefaultPutOpts()
+	opts.TTR = time.Second
+
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer client.Quit()
+	_, err = client.Use("worker-keepalive-tube")
+	require.NoError(t, err)
+	id, err := client.Put([]byte("test job"), opts)
+	require.NoError(t, err)
+
+	done := make(chan *jackd.JobStats, 1)
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		time.Sleep(1500 * time.Millisecond)
+		stats, err := job.Stats()
+		done <- stats
+		return err
+	}, workerOpts("worker-keepalive-tube"))
+	require.NoError(t, worker.Start(context.Background()))
+
+	stats := <-done
+	require.NoError(t, worker.Stop(context.Background()))
+
+	// The job was never handed to the worker's other connection
+	require.NotNil(t, stats)
+	assert.Equal(t, uint32(1), stats.Reserves)
+	assert.Equal(t, uint32(0), stats.Timeouts)
+
+	_, _, err = client.Peek(id)
+	assert.ErrorIs(t, err, jackd.ErrNotFound)
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+	backoff := jackd.FibonacciBackoff{Unit: time.Second, Max: 10 * time.Second, MaxAttempts: 8}
+
+	var delays []time.Duration
+	for failures := 1; ; failures++ {
+		delay, ok := backoff.Next(failures)
+		if !ok {
+			break
+		}
+		delays = append(delays, delay/time.Second)
+	}
+	assert.Equal(t, []time.Duration{1, 1, 2, 3, 5, 8, 10}, delays)
+}
+
+func TestBackoffAsRetryPolicy(t *testing.T) {
+	var policy jackd.RetryPolicy = jackd.ExponentialBackoff{
+		Initial:     time.Second,
+		MaxAttempts: 3,
+	}
+
+	delay, retry := policy.Retry(&jackd.JobStats{Reserves: 2}, errors.New("failed"))
+	assert.True(t, retry)
+	assert.Equal(t, 2*time.Second, delay)
+
+	_, retry = policy.Retry(&jackd.JobStats{Reserves: 3}, errors.New("failed"))
+	assert.False(t, retry)
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	policy := jackd.DefaultRetryPolicy()
+
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		delay, retry := policy.Retry(&jackd.JobStats{Reserves: 1}, errors.New("failed"))
+		require.True(t, retry)
+		assert.InDelta(t, float64(10*time.Second), float64(delay), float64(2*time.Second))
+		delays[delay] = true
+	}
+	assert.Greater(t, len(delays), 1, "delays should be jittered")
+
+	_, retry := policy.Retry(&jackd.JobStats{Reserves: 10}, errors.New("failed"))
+	assert.False(t, retry)
+}
+
+func TestWorkerBacksOffOnDeadlineSoon(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var reserves int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "reserve") {
+						atomic.AddInt32(&reserves, 1)
+					}
+					conn.Write([]byte("DEADLINE_SOON\r\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	opts := jackd.DefaultWorkerOpts()
+	var reported int32
+	opts.OnError = func(job *jackd.Job, err error) {
+		atomic.AddInt32(&reported, 1)
+	}
+	worker := jackd.NewWorker(listener.Addr().String(), func(ctx context.Context, job *jackd.Job) error {
+		return nil
+	}, opts)
+	require.NoError(t, worker.Start(context.Background()))
+
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, worker.Stop(context.Background()))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reserves))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&reported))
+}
+
+func TestWorkerRetryPolicy(t *testing.T) {
+	id := putTo(t, "worker-retry-tube", "test job")[0]
+
+	var attempts int32
+	buried := make(chan struct{})
+	opts := workerOpts("worker-retry-tube")
+	opts.RetryPolicy = jackd.ConstantBackoff{MaxAttempts: 2}
+	opts.OnError = func(job *jackd.Job, err error) {
+		if atomic.AddInt32(&attempts, 1) == 2 {
+			close(buried)
+		}
+	}
+
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		return errors.New("failed")
+	}, opts)
+	require.NoError(t, worker.Start(context.Background()))
+	<-buried
+	require.NoError(t, worker.Stop(context.Background()))
+
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer client.Quit()
+	defer client.Delete(id)
+
+	stats, err := client.JobStats(id)
+	require.NoError(t, err)
+	assert.Equal(t, jackd.JobStateBuried, stats.State)
+	assert.Equal(t, uint32(1), stats.Releases)
+	assert.Equal(t, uint32(2), stats.Reserves)
+}
+
+func (suite *JackdSuite) TestDeadLetter() {
+	_, err := suite.beanstalkd.Use("dlq-source-tube")
+	require.NoError(suite.T(), err)
+	id, err := suite.beanstalkd.Put([]byte("test job"), jackd.DefaultPutOpts())
+	require.NoError(suite.T(), err)
+
+	job, err := suite.beanstalkd.ReserveJobByID(id)
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), job.DeadLetter("dlq-tube", errors.New("boom")))
+	assert.True(suite.T(), job.Finalized())
+
+	_, _, err = suite.beanstalkd.Peek(id)
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+
+	// The client still uses its own tube
+	tube, err := suite.beanstalkd.ListTubeUsed()
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "dlq-source-tube", tube)
+
+	_, err = suite.beanstalkd2.Use("dlq-tube")
+	require.NoError(suite.T(), err)
+	dead, err := suite.beanstalkd2.PeekReadyJob()
+	require.NoError(suite.T(), err)
+
+	letter, err := jackd.ParseDeadLetter(dead.Body)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), id, letter.JobID)
+	assert.Equal(suite.T(), "dlq-source-tube", letter.Tube)
+	assert.Equal(suite.T(), "boom", letter.Error)
+	assert.Equal(suite.T(), uint32(1), letter.Attempts)
+	assert.Equal(suite.T(), []byte("test job"), letter.Body)
+	assert.WithinDuration(suite.T(), time.Now(), letter.FailedAt, 5*time.Second)
+
+	replayed, err := suite.beanstalkd.ReplayDeadLetters("dlq-tube", 0)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, replayed)
+
+	replayedJob, err := suite.beanstalkd.PeekReadyJob()
+	require.NoError(suite.T(), err)
+	defer replayedJob.Delete()
+	assert.Equal(suite.T(), []byte("test job"), replayedJob.Body)
+
+	_, err = suite.beanstalkd2.PeekReadyJob()
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+}
+
+func (suite *JackdSuite) TestReplayBuriesInvalidDeadLetters() {
+	_, err := suite.beanstalkd.Use("dlq-invalid-tube")
+	require.NoError(suite.T(), err)
+	id, err := suite.beanstalkd.Put([]byte("not a dead letter"), jackd.DefaultPutOpts())
+	require.NoError(suite.T(), err)
+	defer suite.beanstalkd.Delete(id)
+
+	replayed, err := suite.beanstalkd.ReplayDeadLetters("dlq-invalid-tube", 0)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, replayed)
+
+	stats, err := suite.beanstalkd.JobStats(id)
+	require.NoError(suite.T(), err)
+	assert.Equal(suite.T(), jackd.JobStateBuried, stats.State)
+}
+
+func TestPipelinedReplayWaitsForPendingReserve(t *testing.T) {
+	client, err := jackd.Dial("localhost:11300", jackd.WithPipelining())
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Watch("pipelined-dlq-reserve-tube")
+	require.NoError(t, err)
+	_, err = client.Ignore("default")
+	require.NoError(t, err)
+
+	reserved := make(chan error, 1)
+	go func() {
+		id, _, err := client.Reserve()
+		if err == nil {
+			err = client.Delete(id)
+		}
+		reserved <- err
+	}()
+
+	// Give the reserve a moment to be sent
+	time.Sleep(50 * time.Millisecond)
+
+	// Replaying has to know the tube in use, so it waits for the reserve,
+	// and gives up without sending anything
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ReplayDeadLettersContext(ctx, "pipelined-dlq-tube", 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	select {
+	case err := <-reserved:
+		t.Fatalf("reserve returned early: %v", err)
+	default:
+	}
+
+	// The connection was left alone
+	putTo(t, "pipelined-dlq-reserve-tube", "wake up")
+	require.NoError(t, <-reserved)
+
+	replayed, err := client.ReplayDeadLetters("pipelined-dlq-tube", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	tube, err := client.ListTubeUsed()
+	require.NoError(t, err)
+	assert.Equal(t, "default", tube)
+}
+
+func TestWorkerDeadLetterTube(t *testing.T) {
+	id := putTo(t, "worker-dlq-source-tube", "test job")[0]
+
+	failed := make(chan struct{})
+	opts := workerOpts("worker-dlq-source-tube")
+	opts.BuryOnError = true
+	opts.DeadLetterTube = "worker-dlq-tube"
+	opts.OnError = func(job *jackd.Job, err error) {
+		close(failed)
+	}
+
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		return errors.New("boom")
+	}, opts)
+	require.NoError(t, worker.Start(context.Background()))
+	<-failed
+	require.NoError(t, worker.Stop(context.Background()))
+
+	client, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, _, err = client.Peek(id)
+	assert.ErrorIs(t, err, jackd.ErrNotFound)
+
+	_, err = client.Use("worker-dlq-tube")
+	require.NoError(t, err)
+	dead, err := client.PeekReadyJob()
+	require.NoError(t, err)
+	defer dead.Delete()
+
+	letter, err := jackd.ParseDeadLetter(dead.Body)
+	require.NoError(t, err)
+	assert.Equal(t, id, letter.JobID)
+	assert.Equal(t, "boom", letter.Error)
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) jackd.Middleware {
+		return func(next jackd.Handler) jackd.Handler {
+			return func(ctx context.Context, job *jackd.Job) error {
+				calls = append(calls, name+" before")
+				err := next(ctx, job)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+
+	handler := jackd.Chain(trace("a"), trace("b"), trace("c"))(func(ctx context.Context, job *jackd.Job) error {
+		calls = append(calls, "handler")
+		return nil
+	})
+	require.NoError(t, handler(context.Background(), &jackd.Job{ID: 1}))
+
+	assert.Equal(t, []string{
+		"a before", "b before", "c before",
+		"handler",
+		"c after", "b after", "a after",
+	}, calls)
+}
+
+func TestBuiltinMiddleware(t *testing.T) {
+	var logged []string
+	var took time.Duration
+	var timedErr error
+
+	handler := jackd.Chain(
+		jackd.Logging(func(format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		}),
+		jackd.Timing(func(job *jackd.Job, d time.Duration, err error) {
+			took, timedErr = d, err
+		}),
+		jackd.Recover(),
+		jackd.Timeout(time.Second),
+		jackd.Decode(func(body []byte) (interface{}, error) {
+			if len(body) == 0 {
+				return nil, errors.New("empty body")
+			}
+			return string(body), nil
+		}),
+	)(func(ctx context.Context, job *jackd.Job) error {
+		_, hasDeadline := ctx.Deadline()
+		assert.True(t, hasDeadline)
+		if jackd.Decoded(ctx) == "panic" {
+			panic("boom")
+		}
+		return nil
+	})
+
+	job := &jackd.Job{ID: 1, Tube: "middleware", Body: []byte("secret payload")}
+	require.NoError(t, handler(context.Background(), job))
+	assert.NoError(t, timedErr)
+	assert.Greater(t, took, time.Duration(0))
+
+	err := handler(context.Background(), &jackd.Job{ID: 2, Tube: "middleware", Body: []byte("panic")})
+	var panicErr *jackd.PanicError
+	require.ErrorAs(t, err, &panicErr)
+	assert.Equal(t, "boom", panicErr.Value)
+	assert.Equal(t, err, timedErr, "Timing is outside of Recover and sees the error")
+
+	err = handler(context.Background(), &jackd.Job{ID: 3, Tube: "middleware"})
+	assert.EqualError(t, err, "decoding job 3: empty body")
+
+	require.Len(t, logged, 3)
+	assert.Contains(t, logged[0], `job 1 from "middleware" done`)
+	assert.Contains(t, logged[1], `job 2 from "middleware" failed`)
+	for _, line := range logged {
+		assert.NotContains(t, line, "secret payload")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	handler := jackd.RateLimit(50*time.Millisecond, 2)(func(ctx context.Context, job *jackd.Job) error {
+		return nil
+	})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, handler(context.Background(), &jackd.Job{}))
+	}
+	// Two jobs go through at once, the other two wait for their turn
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, handler(ctx, &jackd.Job{}), context.Canceled)
+}
+
+func TestWorkerMiddleware(t *testing.T) {
+	putTo(t, "worker-middleware-tube", "test job")
+
+	seen := make(chan string, 1)
+	opts := workerOpts("worker-middleware-tube")
+	opts.Middleware = []jackd.Middleware{
+		jackd.Decode(func(body []byte) (interface{}, error) {
+			return "decoded " + string(body), nil
+		}),
+	}
+
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		seen <- jackd.Decoded(ctx).(string)
+		return nil
+	}, opts)
+	require.NoError(t, worker.Start(context.Background()))
+	defer worker.Stop(context.Background())
+
+	select {
+	case value := <-seen:
+		assert.Equal(t, "decoded test job", value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was never handled")
+	}
+}
+
+func (suite *JackdSuite) TestProtocolError() {
+	err := suite.beanstalkd.Delete(4242424)
+
+	var protocolErr *jackd.ProtocolError
+	require.ErrorAs(suite.T(), err, &protocolErr)
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotFound)
+	assert.Equal(suite.T(), "delete", protocolErr.Command)
+	assert.Equal(suite.T(), uint32(4242424), protocolErr.JobID)
+	assert.Equal(suite.T(), "NOT_FOUND", protocolErr.Response)
+	assert.EqualError(suite.T(), err, "delete job 4242424: job not found")
+
+	_, err = suite.beanstalkd.Ignore("default")
+	require.ErrorAs(suite.T(), err, &protocolErr)
+	assert.ErrorIs(suite.T(), err, jackd.ErrNotIgnored)
+	assert.Equal(suite.T(), "ignore", protocolErr.Command)
+	assert.Equal(suite.T(), "default", protocolErr.Tube)
+
+	stats, err := suite.beanstalkd.ServerStats()
+	require.NoError(suite.T(), err)
+	_, err = suite.beanstalkd.Put(make([]byte, stats.MaxJobSize+1), jackd.DefaultPutOpts())
+	require.ErrorAs(suite.T(), err, &protocolErr)
+	assert.ErrorIs(suite.T(), err, jackd.ErrJobTooBig)
+	assert.Equal(suite.T(), "put", protocolErr.Command)
+	assert.Equal(suite.T(), "default", protocolErr.Tube)
+	assert.Equal(suite.T(), "JOB_TOO_BIG", protocolErr.Response)
+
+	// Each failed item of a batch describes its own command
+	err = suite.beanstalkd.DeleteMany([]uint32{4242424})
+	require.ErrorAs(suite.T(), err, &protocolErr)
+	assert.Equal(suite.T(), uint32(4242424), protocolErr.JobID)
+}
+
+func TestBuriedError(t *testing.T) {
+	client, err := jackd.Dial(serve(t, []byte("BURIED 42\r\n")))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	// The job was created, and its id isn't lost
+	id, err := client.Put([]byte("test"), jackd.DefaultPutOpts())
+	var buriedErr *jackd.BuriedError
+	require.ErrorAs(t, err, &buriedErr)
+	assert.ErrorIs(t, err, jackd.ErrBuried)
+	assert.Equal(t, uint32(42), id)
+	assert.Equal(t, uint32(42), buriedErr.ID)
+
+	client, err = jackd.Dial(serve(t, []byte("BURIED\r\n")))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	err = client.Release(7, jackd.ReleaseOpts{})
+	require.ErrorAs(t, err, &buriedErr)
+	assert.ErrorIs(t, err, jackd.ErrBuried)
+	assert.Equal(t, uint32(7), buriedErr.ID)
+}
+
+func TestUnexpectedResponseError(t *testing.T) {
+	client, err := jackd.Dial(serve(t, []byte("WHAT\r\n")))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	err = client.Touch(1)
+	var unexpectedErr *jackd.UnexpectedResponseError
+	require.ErrorAs(t, err, &unexpectedErr)
+	assert.Equal(t, "touch", unexpectedErr.Command)
+	assert.Equal(t, "WHAT", unexpectedErr.Response)
+
+	var protocolErr *jackd.ProtocolError
+	assert.False(t, errors.As(err, &protocolErr))
+}
+
+func TestErrorClassification(t *testing.T) {
+	p := newProxy(t)
+	client, err := jackd.Dial(p.addr())
+	require.NoError(t, err)
+
+	p.cut()
+
+	_, err = client.ListTubeUsed()
+	assert.True(t, jackd.IsConnectionError(err))
+	assert.True(t, jackd.IsRetryable(err))
+	assert.False(t, jackd.IsProtocolError(err))
+
+	// The client fails fast from then on
+	_, err = client.ListTubeUsed()
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+	assert.True(t, jackd.IsConnectionError(err))
+
+	for _, err := range []error{jackd.ErrOutOfMemory, jackd.ErrDraining, jackd.ErrInternalError} {
+		err = &jackd.ProtocolError{Command: "put", Err: err}
+		assert.True(t, jackd.IsTemporary(err), err)
+		assert.True(t, jackd.IsRetryable(err), err)
+		assert.True(t, jackd.IsProtocolError(err), err)
+		assert.False(t, jackd.IsConnectionError(err), err)
+	}
+
+	for _, err := range []error{jackd.ErrTimedOut, jackd.ErrDeadlineSoon} {
+		assert.False(t, jackd.IsTemporary(err), err)
+		assert.True(t, jackd.IsRetryable(err), err)
+	}
+
+	for _, err := range []error{
+		jackd.ErrNotFound,
+		jackd.ErrJobTooBig,
+		&jackd.BuriedError{ID: 1},
+		context.Canceled,
+		context.DeadlineExceeded,
+	} {
+		assert.False(t, jackd.IsRetryable(err), err)
+		assert.False(t, jackd.IsConnectionError(err), err)
+	}
+}
+
+func TestUnexpectedResponseClosesClient(t *testing.T) {
+	client, err := jackd.Dial(serve(t, []byte("WHAT\r\n")))
+	require.NoError(t, err)
+
+	err = client.Touch(1)
+	assert.True(t, jackd.IsProtocolError(err))
+
+	err = client.Touch(1)
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+}
+
+func TestUnexpectedResponseFailsBatch(t *testing.T) {
+	client, err := jackd.Dial(serve(t, []byte("WHAT\r\n")))
+	require.NoError(t, err)
+
+	err = client.DeleteMany([]uint32{1, 2, 3})
+	var unexpectedErr *jackd.UnexpectedResponseError
+	require.ErrorAs(t, err, &unexpectedErr)
+	var batchErr *jackd.BatchError
+	assert.False(t, errors.As(err, &batchErr))
+
+	_, err = client.PutMany([]jackd.PutJob{{Body: []byte("a")}})
+	assert.ErrorIs(t, err, jackd.ErrClosed)
+}
+
+type logRecord struct {
+	level string
+	msg   string
+	attrs map[string]interface{}
+}
+
+// recordingLogger is a jackd.Logger keeping what it is given.
+type recordingLogger struct {
+	mutex   sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) log(level string, msg string, args []interface{}) {
+	attrs := make(map[string]interface{})
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[args[i].(string)] = args[i+1]
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.records = append(l.records, logRecord{level, msg, attrs})
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+func (l *recordingLogger) find(msg string, command string) []logRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var found []logRecord
+	for _, record := range l.records {
+		if record.msg == msg && (command == "" || record.attrs["command"] == command) {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+func TestLogger(t *testing.T) {
+	logger := new(recordingLogger)
+	client, err := jackd.Dial("localhost:11300", jackd.WithLogger(logger))
+	require.NoError(t, err)
+
+	_, err = client.Use("logger-tube")
+	require.NoError(t, err)
+	id, err := client.Put([]byte("secret payload"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	_, _, err = client.PeekReady()
+	require.NoError(t, err)
+	require.NoError(t, client.Delete(id))
+	assert.Error(t, client.Delete(id))
+	require.NoError(t, client.Quit())
+
+	assert.Len(t, logger.find("connected", ""), 1)
+	assert.Len(t, logger.find("disconnected", ""), 1)
+
+	puts := logger.find("command done", "put")
+	require.Len(t, puts, 1)
+	assert.Equal(t, "debug", puts[0].level)
+	assert.Equal(t, id, puts[0].attrs["job"])
+	assert.Equal(t, "logger-tube", puts[0].attrs["tube"])
+	assert.Contains(t, puts[0].attrs, "duration")
+
+	peeks := logger.find("command done", "peek-ready")
+	require.Len(t, peeks, 1)
+	assert.Equal(t, id, peeks[0].attrs["job"])
+
+	failures := logger.find("error response", "delete")
+	require.Len(t, failures, 1)
+	assert.Equal(t, "info", failures[0].level)
+	assert.Equal(t, "NOT_FOUND", failures[0].attrs["response"])
+
+	for _, record := range logger.records {
+		assert.NotContains(t, record.attrs, "body")
+	}
+}
+
+func TestPayloadLogging(t *testing.T) {
+	logger := new(recordingLogger)
+	client, err := jackd.Dial("localhost:11300", jackd.WithLogger(logger), jackd.WithPayloadLogging())
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Use("payload-logging-tube")
+	require.NoError(t, err)
+	id, err := client.Put([]byte("test payload"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	defer client.Delete(id)
+	_, _, err = client.Peek(id)
+	require.NoError(t, err)
+
+	for _, command := range []string{"put", "peek"} {
+		records := logger.find("command done", command)
+		require.Len(t, records, 1)
+		assert.Equal(t, "test payload", records[0].attrs["body"])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	collector := metrics.New()
+	client, err := jackd.Dial("localhost:11300", jackd.WithMetrics(collector))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Use("metrics-tube")
+	require.NoError(t, err)
+	id, err := client.Put([]byte("test"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	require.NoError(t, client.Delete(id))
+	assert.Error(t, client.Delete(id))
+	_, err = client.Watch("metrics-tube")
+	require.NoError(t, err)
+	_, _, err = client.ReserveWithTimeout(0)
+	assert.ErrorIs(t, err, jackd.ErrTimedOut)
+
+	snapshot := collector.Snapshot()
+	assert.Equal(t, map[string]uint64{"INSERTED": 1}, snapshot.Commands["put"].Outcomes)
+	assert.Equal(t, map[string]uint64{"DELETED": 1, "NOT_FOUND": 1}, snapshot.Commands["delete"].Outcomes)
+	assert.Equal(t, map[string]uint64{"TIMED_OUT": 1}, snapshot.Commands["reserve-with-timeout"].Outcomes)
+	assert.Equal(t, uint64(2), snapshot.Commands["delete"].Count)
+	assert.Equal(t, uint64(2), snapshot.Commands["delete"].Buckets["+Inf"])
+	assert.Zero(t, snapshot.Commands["delete"].InFlight)
+	assert.Greater(t, snapshot.BytesRead, int64(0))
+	assert.Greater(t, snapshot.BytesWritten, int64(0))
+
+	// Published through expvar
+	expvar.Publish("jackd-test", collector)
+	var published metrics.Snapshot
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("jackd-test").String()), &published))
+	assert.Equal(t, snapshot.Commands["put"].Outcomes, published.Commands["put"].Outcomes)
+
+	// And in the Prometheus text format
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	exposition, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain; version=0.0.4")
+	assert.Contains(t, string(exposition), "# TYPE jackd_command_duration_seconds histogram\n")
+	assert.Contains(t, string(exposition), `jackd_commands_total{command="delete",outcome="NOT_FOUND"} 1`+"\n")
+	assert.Contains(t, string(exposition), `jackd_command_duration_seconds_bucket{command="delete",le="+Inf"} 2`+"\n")
+	assert.Contains(t, string(exposition), `jackd_command_duration_seconds_count{command="delete"} 2`+"\n")
+	assert.Contains(t, string(exposition), `jackd_commands_in_flight{command="put"} 0`+"\n")
+}
+
+func TestMetricsInFlight(t *testing.T) {
+	collector := metrics.New()
+	client, err := jackd.Dial("localhost:11300", jackd.WithMetrics(collector))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Watch("metrics-in-flight-tube")
+	require.NoError(t, err)
+	_, err = client.Ignore("default")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.ReserveContext(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return collector.Snapshot().Commands["reserve"].InFlight == 1
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+	reserve := collector.Snapshot().Commands["reserve"]
+	assert.Zero(t, reserve.InFlight)
+	assert.Equal(t, map[string]uint64{"CANCELLED": 1}, reserve.Outcomes)
+}
+
+func TestObserverSpans(t *testing.T) {
+	recorder := new(tracing.Recorder)
+	client, err := jackd.Dial("localhost:11300", jackd.WithObserver(tracing.NewObserver(recorder)))
+	require.NoError(t, err)
+	defer client.Quit()
+
+	_, err = client.Use("observer-tube")
+	require.NoError(t, err)
+	_, err = client.Watch("observer-tube")
+	require.NoError(t, err)
+	_, err = client.Ignore("default")
+	require.NoError(t, err)
+
+	// Commands are traced as children of the span in their context
+	ctx, parent := recorder.Start(context.Background(), "handle request")
+	id, err := client.PutContext(ctx, []byte("secret payload"), jackd.PutOpts{Priority: 5, TTR: time.Minute})
+	require.NoError(t, err)
+	parent.End()
+
+	reserved, _, err := client.ReserveWithTimeout(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, id, reserved)
+	require.NoError(t, client.Delete(id))
+	assert.Error(t, client.Delete(id))
+
+	spans := make(map[string][]*tracing.RecordedSpan)
+	for _, span := range recorder.Spans() {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+
+	require.Len(t, spans["beanstalkd put"], 1)
+	put := spans["beanstalkd put"][0]
+	assert.Equal(t, "handle request", put.Parent.Name)
+	assert.Equal(t, "beanstalkd", put.Attributes["messaging.system"])
+	assert.Equal(t, "put", put.Attributes["messaging.operation"])
+	assert.Equal(t, "observer-tube", put.Attributes["messaging.destination.name"])
+	assert.Equal(t, id, put.Attributes["messaging.message.id"])
+	assert.Equal(t, "5 0 60 14", put.Attributes["beanstalkd.args"])
+	assert.Empty(t, put.Errors)
+	assert.False(t, put.End.Before(put.Start))
+
+	require.Len(t, spans["beanstalkd reserve-with-timeout"], 1)
+	reserve := spans["beanstalkd reserve-with-timeout"][0]
+	assert.Nil(t, reserve.Parent)
+	assert.Equal(t, id, reserve.Attributes["messaging.message.id"])
+	assert.Equal(t, "1", reserve.Attributes["beanstalkd.args"])
+
+	require.Len(t, spans["beanstalkd delete"], 2)
+	for _, span := range spans["beanstalkd delete"] {
+		assert.Equal(t, id, span.Attributes["messaging.message.id"])
+	}
+	assert.Empty(t, spans["beanstalkd delete"][0].Errors)
+	require.Len(t, spans["beanstalkd delete"][1].Errors, 1)
+	assert.EqualError(t, spans["beanstalkd delete"][1].Errors[0], fmt.Sprintf("delete job %d: job not found", id))
+
+	for _, span := range recorder.Spans() {
+		for _, value := range span.Attributes {
+			assert.NotEqual(t, "secret payload", value)
+		}
+	}
+}
+
+func TestEnvelopeEncoding(t *testing.T) {
+	data := jackd.EncodeEnvelope(jackd.Headers{jackd.HeaderCorrelationID: "abc"}, []byte("payload"))
+
+	headers, body, err := jackd.DecodeEnvelope(data)
+	require.NoError(t, err)
+	assert.Equal(t, jackd.Headers{jackd.HeaderCorrelationID: "abc"}, headers)
+	assert.Equal(t, []byte("payload"), body)
+
+	// Plain payloads are not envelopes
+	headers, body, err = jackd.DecodeEnvelope([]byte("plain payload"))
+	require.NoError(t, err)
+	assert.Nil(t, headers)
+	assert.Equal(t, []byte("plain payload"), body)
+
+	_, _, err = jackd.DecodeEnvelope(data[:len(data)-len("payload")-1])
+	assert.ErrorIs(t, err, jackd.ErrInvalidEnvelope)
+
+	unsupported := append([]byte(nil), data...)
+	unsupported[len("\x00jackd")] = 2
+	_, _, err = jackd.DecodeEnvelope(unsupported)
+	assert.ErrorIs(t, err, jackd.ErrInvalidEnvelope)
+}
+
+func TestEnvelopes(t *testing.T) {
+	producer, err := jackd.Dial("localhost:11300", jackd.WithEnvelopes())
+	require.NoError(t, err)
+	defer producer.Quit()
+	consumer, err := jackd.Dial("localhost:11300", jackd.WithEnvelopes())
+	require.NoError(t, err)
+	defer consumer.Quit()
+
+	_, err = producer.Use("envelope-tube")
+	require.NoError(t, err)
+	_, err = consumer.Watch("envelope-tube")
+	require.NoError(t, err)
+	_, err = consumer.Ignore("default")
+	require.NoError(t, err)
+
+	ctx := jackd.ContextWithHeader(context.Background(), jackd.HeaderTraceparent, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx = jackd.ContextWithHeader(ctx, jackd.HeaderCorrelationID, "request-1")
+
+	before := time.Now()
+	_, err = producer.PutContext(ctx, []byte("put"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	_, err = producer.PutReaderContext(ctx, bytes.NewReader([]byte("put-reader")), int64(len("put-reader")), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	_, err = producer.PutManyContext(ctx, []jackd.PutJob{{Body: []byte("put-many"), Opts: jackd.DefaultPutOpts()}})
+	require.NoError(t, err)
+	// Plain jobs still work
+	plain, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer plain.Quit()
+	_, err = plain.Use("envelope-tube")
+	require.NoError(t, err)
+	_, err = plain.Put([]byte("plain"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+
+	for _, expected := range []string{"put", "put-reader", "put-many"} {
+		job, err := consumer.ReserveNextJobWithTimeout(time.Second)
+		require.NoError(t, err)
+		require.NoError(t, job.Delete())
+
+		assert.Equal(t, expected, string(job.Body))
+		assert.Equal(t, "request-1", job.Headers[jackd.HeaderCorrelationID])
+		assert.Contains(t, job.Headers[jackd.HeaderTraceparent], "0af7651916cd43dd8448eb211c80319c")
+		assert.WithinDuration(t, before, job.Headers.EnqueuedAt(), time.Minute)
+
+		// The headers follow the jobs put on the job's behalf
+		assert.Equal(t, "request-1", jackd.HeadersFromContext(job.Context(context.Background()))[jackd.HeaderCorrelationID])
+	}
+
+	job, err := consumer.ReserveNextJobWithTimeout(time.Second)
+	require.NoError(t, err)
+	require.NoError(t, job.Delete())
+	assert.Equal(t, "plain", string(job.Body))
+	assert.Nil(t, job.Headers)
+}
+
+func TestDeadLettersFromEnvelopesReplayAnywhere(t *testing.T) {
+	client, err := jackd.Dial("localhost:11300", jackd.WithEnvelopes())
+	require.NoError(t, err)
+	defer client.Quit()
+	_, err = client.Use("envelope-dlq-source-tube")
+	require.NoError(t, err)
+
+	ctx := jackd.ContextWithHeader(context.Background(), jackd.HeaderCorrelationID, "request-3")
+	id, err := client.PutContext(ctx, []byte("test job"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	job, err := client.ReserveJobByID(id)
+	require.NoError(t, err)
+	require.NoError(t, job.DeadLetter("envelope-dlq-tube", errors.New("boom")))
+
+	plain, err := jackd.Dial("localhost:11300")
+	require.NoError(t, err)
+	defer plain.Quit()
+
+	// The letter is plain JSON, for clients and tools without envelopes
+	_, err = plain.Use("envelope-dlq-tube")
+	require.NoError(t, err)
+	dead, err := plain.PeekReadyJob()
+	require.NoError(t, err)
+	letter, err := jackd.ParseDeadLetter(dead.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test job"), letter.Body)
+	assert.Equal(t, "request-3", letter.Headers[jackd.HeaderCorrelationID])
+
+	replayed, err := plain.ReplayDeadLetters("envelope-dlq-tube", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	// The job keeps its envelope and original headers
+	_, err = client.Use("envelope-dlq-source-tube")
+	require.NoError(t, err)
+	replayedJob, err := client.PeekReadyJob()
+	require.NoError(t, err)
+	require.NoError(t, replayedJob.Delete())
+	assert.Equal(t, []byte("test job"), replayedJob.Body)
+	assert.Equal(t, "request-3", replayedJob.Headers[jackd.HeaderCorrelationID])
+	assert.Equal(t, letter.Headers[jackd.HeaderEnqueuedAt], replayedJob.Headers[jackd.HeaderEnqueuedAt])
+
+	// A plain job stays plain, even when replayed by a client using envelopes
+	_, err = plain.Use("envelope-dlq-source-tube")
+	require.NoError(t, err)
+	id, err = plain.Put([]byte("plain job"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+	job, err = plain.ReserveJobByID(id)
+	require.NoError(t, err)
+	require.NoError(t, job.DeadLetter("envelope-dlq-tube", errors.New("boom")))
+
+	replayed, err = client.ReplayDeadLetters("envelope-dlq-tube", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	replayedJob, err = plain.PeekReadyJob()
+	require.NoError(t, err)
+	require.NoError(t, replayedJob.Delete())
+	assert.Equal(t, []byte("plain job"), replayedJob.Body)
+}
+
+func TestWorkerRestoresHeaders(t *testing.T) {
+	producer, err := jackd.Dial("localhost:11300", jackd.WithEnvelopes())
+	require.NoError(t, err)
+	defer producer.Quit()
+	_, err = producer.Use("worker-envelope-tube")
+	require.NoError(t, err)
+
+	ctx := jackd.ContextWithHeader(context.Background(), jackd.HeaderCorrelationID, "request-2")
+	_, err = producer.PutContext(ctx, []byte("test job"), jackd.DefaultPutOpts())
+	require.NoError(t, err)
+
+	type handled struct {
+		body          string
+		correlationID string
+	}
+	seen := make(chan handled, 1)
+	worker := jackd.NewWorker("localhost:11300", func(ctx context.Context, job *jackd.Job) error {
+		seen <- handled{string(job.Body), jackd.HeadersFromContext(ctx)[jackd.HeaderCorrelationID]}
+		return nil
+	}, workerOpts("worker-envelope-tube"), jackd.WithEnvelopes())
+	require.NoError(t, worker.Start(context.Background()))
+	defer worker.Stop(context.Background())
+
+	select {
+	case job := <-seen:
+		assert.Equal(t, handled{"test job", "request-2"}, job)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was never handled")
+	}
+}
@@ -0,0 +1,74 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Metrics is told about the commands a client runs, for instance to keep
+// latency histograms or counts by outcome. Its methods are called from the
+// goroutines running commands, and must be safe for concurrent use.
+type Metrics interface {
+	// CommandStarted is called before a command is sent.
+	CommandStarted(command string)
+	// CommandFinished is called once the command is over, with how it ended:
+	// the keyword of the server's response, such as INSERTED or NOT_FOUND,
+	// or CANCELLED, UNEXPECTED_RESPONSE or ERROR when there was no response
+	// to speak of.
+	CommandFinished(command string, outcome string, took time.Duration)
+	// BytesRead and BytesWritten count the bytes exchanged with the server.
+	BytesRead(n int)
+	BytesWritten(n int)
+}
+
+// successResponses are the responses to the commands that succeeded, when
+// they aren't OK.
+var successResponses = map[string]string{
+	"put":                  "INSERTED",
+	"use":                  "USING",
+	"reserve":              "RESERVED",
+	"reserve-with-timeout": "RESERVED",
+	"reserve-job":          "RESERVED",
+	"delete":               "DELETED",
+	"release":              "RELEASED",
+	"bury":                 "BURIED",
+	"touch":                "TOUCHED",
+	"watch":                "WATCHING",
+	"ignore":               "WATCHING",
+	"peek":                 "FOUND",
+	"peek-ready":           "FOUND",
+	"peek-delayed":         "FOUND",
+	"peek-buried":          "FOUND",
+	"kick":                 "KICKED",
+	"kick-job":             "KICKED",
+	"list-tube-used":       "USING",
+	"pause-tube":           "PAUSED",
+}
+
+// outcome tells how op ended, as reported to Metrics.
+func outcome(op *operation, err error) string {
+	if err == nil {
+		if response, ok := successResponses[op.name]; ok {
+			return response
+		}
+		return "OK"
+	}
+
+	var protocolErr *ProtocolError
+	var unexpectedErr *UnexpectedResponseError
+	switch {
+	case errors.As(err, &protocolErr):
+		if fields := strings.Fields(protocolErr.Response); len(fields) > 0 {
+			return fields[0]
+		}
+		return "ERROR"
+	case errors.As(err, &unexpectedErr):
+		return "UNEXPECTED_RESPONSE"
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return "CANCELLED"
+	default:
+		return "ERROR"
+	}
+}
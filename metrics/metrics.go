@@ -0,0 +1,263 @@
+// Package metrics collects the metrics of jackd clients, and exposes them
+// through expvar or in the Prometheus text format:
+//
+//	collector := metrics.New()
+//	client, err := jackd.Dial("localhost:11300", jackd.WithMetrics(collector))
+//
+//	expvar.Publish("jackd", collector)
+//	http.Handle("/metrics", collector)
+//
+// A collector may be shared by many clients, such as those of a pool.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histograms
+// of collectors made by New.
+var DefaultBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Collector is a jackd.Metrics keeping, for each command, a latency histogram,
+// counts by outcome and the number in flight, along with the bytes exchanged
+// with the server. It is an expvar.Var, and an http.Handler serving the
+// Prometheus text format.
+type Collector struct {
+	buckets []float64
+
+	mutex    sync.Mutex
+	commands map[string]*command
+
+	bytesRead    int64
+	bytesWritten int64
+}
+
+type command struct {
+	inFlight int64
+	outcomes map[string]uint64
+	// counts holds the number of commands per bucket, not cumulative, with
+	// the ones over the last bucket at the end.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// New makes a collector whose latency histograms have DefaultBuckets.
+func New() *Collector {
+	return NewWithBuckets(DefaultBuckets)
+}
+
+// NewWithBuckets makes a collector whose latency histograms have the given
+// upper bounds, in seconds and in increasing order.
+func NewWithBuckets(buckets []float64) *Collector {
+	return &Collector{
+		buckets:  buckets,
+		commands: make(map[string]*command),
+	}
+}
+
+// command returns the metrics of name. It must be called with the mutex
+// held.
+func (c *Collector) command(name string) *command {
+	cmd, ok := c.commands[name]
+	if !ok {
+		cmd = &command{
+			outcomes: make(map[string]uint64),
+			counts:   make([]uint64, len(c.buckets)+1),
+		}
+		c.commands[name] = cmd
+	}
+	return cmd
+}
+
+func (c *Collector) CommandStarted(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.command(name).inFlight++
+}
+
+func (c *Collector) CommandFinished(name string, outcome string, took time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cmd := c.command(name)
+	cmd.inFlight--
+	cmd.outcomes[outcome]++
+
+	seconds := took.Seconds()
+	cmd.counts[sort.SearchFloat64s(c.buckets, seconds)]++
+	cmd.count++
+	cmd.sum += seconds
+}
+
+func (c *Collector) BytesRead(n int) {
+	atomic.AddInt64(&c.bytesRead, int64(n))
+}
+
+func (c *Collector) BytesWritten(n int) {
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+}
+
+// Snapshot is the state of a collector at some point, as published to expvar.
+type Snapshot struct {
+	Commands     map[string]CommandSnapshot `json:"commands"`
+	BytesRead    int64                      `json:"bytes_read"`
+	BytesWritten int64                      `json:"bytes_written"`
+}
+
+type CommandSnapshot struct {
+	InFlight int64             `json:"in_flight"`
+	Outcomes map[string]uint64 `json:"outcomes"`
+	// Buckets maps the upper bounds of the latency histogram, formatted as
+	// in the Prometheus text format, to the number of commands that took at
+	// most that long.
+	Buckets map[string]uint64 `json:"buckets"`
+	Count   uint64            `json:"count"`
+	// Sum is the total time taken by the commands, in seconds.
+	Sum float64 `json:"sum_seconds"`
+}
+
+func (c *Collector) Snapshot() Snapshot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	snapshot := Snapshot{
+		Commands:     make(map[string]CommandSnapshot, len(c.commands)),
+		BytesRead:    atomic.LoadInt64(&c.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+	}
+
+	for name, cmd := range c.commands {
+		outcomes := make(map[string]uint64, len(cmd.outcomes))
+		for outcome, n := range cmd.outcomes {
+			outcomes[outcome] = n
+		}
+
+		buckets := make(map[string]uint64, len(cmd.counts))
+		var cumulative uint64
+		for i, n := range cmd.counts {
+			cumulative += n
+			buckets[c.bound(i)] = cumulative
+		}
+
+		snapshot.Commands[name] = CommandSnapshot{
+			InFlight: cmd.inFlight,
+			Outcomes: outcomes,
+			Buckets:  buckets,
+			Count:    cmd.count,
+			Sum:      cmd.sum,
+		}
+	}
+
+	return snapshot
+}
+
+// bound formats the upper bound of bucket i.
+func (c *Collector) bound(i int) string {
+	if i == len(c.buckets) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(c.buckets[i], 'g', -1, 64)
+}
+
+// String returns the collector's snapshot as JSON, which makes the collector
+// an expvar.Var.
+func (c *Collector) String() string {
+	data, err := json.Marshal(c.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// ServeHTTP serves the collector's metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = c.WritePrometheus(w)
+}
+
+// WritePrometheus writes the collector's metrics to w in the Prometheus text
+// format.
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	snapshot := c.Snapshot()
+
+	names := make([]string, 0, len(snapshot.Commands))
+	for name := range snapshot.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	p := &printer{w: w}
+
+	p.header("jackd_commands_total", "counter", "Commands run, by outcome.")
+	for _, name := range names {
+		outcomes := snapshot.Commands[name].Outcomes
+		sorted := make([]string, 0, len(outcomes))
+		for outcome := range outcomes {
+			sorted = append(sorted, outcome)
+		}
+		sort.Strings(sorted)
+
+		for _, outcome := range sorted {
+			p.printf("jackd_commands_total{command=%s,outcome=%s} %d\n", label(name), label(outcome), outcomes[outcome])
+		}
+	}
+
+	p.header("jackd_command_duration_seconds", "histogram", "Time taken by commands, from sending them to reading their response.")
+	for _, name := range names {
+		cmd := snapshot.Commands[name]
+		for i := 0; i <= len(c.buckets); i++ {
+			bound := c.bound(i)
+			p.printf("jackd_command_duration_seconds_bucket{command=%s,le=%s} %d\n", label(name), label(bound), cmd.Buckets[bound])
+		}
+		p.printf("jackd_command_duration_seconds_sum{command=%s} %s\n", label(name), strconv.FormatFloat(cmd.Sum, 'g', -1, 64))
+		p.printf("jackd_command_duration_seconds_count{command=%s} %d\n", label(name), cmd.Count)
+	}
+
+	p.header("jackd_commands_in_flight", "gauge", "Commands sent and not answered yet.")
+	for _, name := range names {
+		p.printf("jackd_commands_in_flight{command=%s} %d\n", label(name), snapshot.Commands[name].InFlight)
+	}
+
+	p.header("jackd_read_bytes_total", "counter", "Bytes received from the server.")
+	p.printf("jackd_read_bytes_total %d\n", snapshot.BytesRead)
+	p.header("jackd_written_bytes_total", "counter", "Bytes sent to the server.")
+	p.printf("jackd_written_bytes_total %d\n", snapshot.BytesWritten)
+
+	return p.err
+}
+
+// printer writes to w until it fails, remembering the error.
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *printer) header(name string, kind string, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label quotes a label value.
+func label(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
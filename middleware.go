@@ -0,0 +1,177 @@
+package jackd
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Handler with behaviour of its own, such as logging or
+// timing.
+type Middleware func(Handler) Handler
+
+// Chain composes middlewares into one. The first middleware is the outermost:
+// Chain(a, b)(handler) runs a, which runs b, which runs handler.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(handler Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+		return handler
+	}
+}
+
+// Recover turns a panic in the handler into a *PanicError. Workers already
+// do this around the whole chain; Recover is for handlers run elsewhere, or
+// to let the middlewares outside of it see the error.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+
+			return next(ctx, job)
+		}
+	}
+}
+
+// Logging logs the outcome of each job with logf, which log.Printf fits. Job
+// bodies are never logged.
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) error {
+			start := time.Now()
+			err := next(ctx, job)
+			took := time.Since(start)
+
+			if err != nil {
+				logf("job %d from %q failed after %s: %v", job.ID, job.Tube, took, err)
+			} else {
+				logf("job %d from %q done in %s", job.ID, job.Tube, took)
+			}
+			return err
+		}
+	}
+}
+
+// Timing reports how long each job took to handle, and how it ended.
+func Timing(observe func(job *Job, took time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) error {
+			start := time.Now()
+			err := next(ctx, job)
+			observe(job, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Tracing calls start before each job is handled, to begin a span or the
+// like. The context it returns is passed on to the handler, and the function
+// it returns is called with the handler's error once it is done.
+func Tracing(start func(ctx context.Context, job *Job) (context.Context, func(err error))) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) error {
+			ctx, end := start(ctx, job)
+			err := next(ctx, job)
+			end(err)
+			return err
+		}
+	}
+}
+
+// Timeout cancels the handler's context after timeout. Handlers have to
+// watch their context for this to have any effect.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return next(ctx, job)
+		}
+	}
+}
+
+// RateLimit lets jobs through at an average of one per interval, with bursts
+// of up to burst jobs, across all the handlers it wraps. Jobs wait for their
+// turn, and fail with the context's error if it is done first.
+func RateLimit(interval time.Duration, burst int) Middleware {
+	if burst < 1 {
+		burst = 1
+	}
+	limiter := &rateLimiter{interval: interval, burst: burst}
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) error {
+			if wait := limiter.reserve(); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+
+			return next(ctx, job)
+		}
+	}
+}
+
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mutex sync.Mutex
+	// next is when the next job would be let through if there were no
+	// bursts.
+	next time.Time
+}
+
+// reserve takes a slot and returns how long to wait for it.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	wait := l.next.Sub(now) - time.Duration(l.burst-1)*l.interval
+	l.next = l.next.Add(l.interval)
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+type decodedKey struct{}
+
+// Decode decodes each job's body with decode before it is handled. The
+// handler gets the result from Decoded. A job that can't be decoded fails
+// without reaching the handler.
+func Decode(decode func(body []byte) (interface{}, error)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job) error {
+			value, err := decode(job.Body)
+			if err != nil {
+				return fmt.Errorf("decoding job %d: %w", job.ID, err)
+			}
+
+			return next(context.WithValue(ctx, decodedKey{}, value), job)
+		}
+	}
+}
+
+// Decoded returns the job body decoded by the Decode middleware, or nil.
+func Decoded(ctx context.Context) interface{} {
+	return ctx.Value(decodedKey{})
+}
@@ -0,0 +1,37 @@
+package jackd
+
+import (
+	"context"
+	"time"
+)
+
+// CommandInfo describes a command for an Observer.
+type CommandInfo struct {
+	// Command is the name of the command, such as "put". Batches are named
+	// after their method, such as "put-many".
+	Command string
+	// Args are the arguments sent with the command. Job bodies are never
+	// part of them.
+	Args []string
+	// Tube and JobID are the tube and job the command is about, if any. For
+	// commands such as put or reserve, they are only known afterwards.
+	Tube  string
+	JobID uint32
+	// Duration and Err are how long the command took and how it failed, set
+	// for AfterCommand.
+	Duration time.Duration
+	Err      error
+}
+
+// Observer is called around each command a client runs, as set up with
+// WithObserver. Its methods are called from the goroutines running commands,
+// and must be safe for concurrent use.
+type Observer interface {
+	// BeforeCommand is called before the command is sent, with the context
+	// it was run with. The context it returns, which may carry a span for
+	// instance, is passed to AfterCommand.
+	BeforeCommand(ctx context.Context, info *CommandInfo) context.Context
+	// AfterCommand is called once the command is over, with the same info
+	// completed with what the response told.
+	AfterCommand(ctx context.Context, info *CommandInfo)
+}
@@ -0,0 +1,154 @@
+package jackd
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	network        string
+	connectTimeout time.Duration
+	keepAlive      time.Duration
+	tlsConfig      *tls.Config
+	ioTimeout      time.Duration
+	pipelined      bool
+	backoff        Backoff
+	logger         Logger
+	logPayloads    bool
+	metrics        Metrics
+	observer       Observer
+	envelopes      bool
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{network: "tcp"}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithNetwork sets the network to dial, as understood by net.Dial. The
+// default is "tcp"; use "unix" to connect to beanstalkd started with
+// -l unix:/path/to/socket, passing the socket's path as the address.
+func WithNetwork(network string) Option {
+	return func(o *options) {
+		o.network = network
+	}
+}
+
+// WithConnectTimeout bounds the time it takes to connect, including the TLS
+// handshake if any.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.connectTimeout = timeout
+	}
+}
+
+// WithKeepAlive sets the period between TCP keep-alive probes. Zero keeps
+// the operating system's default and a negative period disables them.
+func WithKeepAlive(period time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = period
+	}
+}
+
+// WithTLS wraps the connection in TLS, for beanstalkd running behind a TLS
+// terminating proxy such as stunnel. If config has no ServerName, the host
+// being dialed is used.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithIOTimeout bounds the time each command may take to be written, and
+// then to be answered. Reserve commands are given their own timeout on top of
+// it, or no limit at all for a plain reserve. A command that times out leaves
+// the connection unusable, so later calls fail with ErrClosed.
+func WithIOTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.ioTimeout = timeout
+	}
+}
+
+// WithPipelining lets callers sharing a Client send their commands without
+// waiting for the responses to earlier commands. Responses are matched to
+// callers in the order the commands were sent, so throughput is no longer
+// bounded by the round trip to the server.
+//
+// A blocking command such as Reserve still holds up the responses to every
+// command sent after it, and cancelling a command that is waiting for its
+// response closes the connection for all of them.
+func WithPipelining() Option {
+	return func(o *options) {
+		o.pipelined = true
+	}
+}
+
+// WithReconnect makes a dialed client reconnect when its connection breaks,
+// waiting between failed attempts as told by backoff. On the new connection,
+// the tube in use and the watched tubes are restored before anything else.
+//
+// A command that was underway when the connection broke is run again if
+// that is harmless, as for reserve or peek commands. Otherwise it fails with
+// an error wrapping ErrOutcomeUnknown, since the server may or may not have
+// carried it out.
+func WithReconnect(backoff Backoff) Option {
+	return func(o *options) {
+		o.backoff = backoff
+	}
+}
+
+// WithLogger logs the client's activity to logger: connecting and
+// disconnecting at the info level, losing the connection at the warn level,
+// and each command at the debug level, or the info level when the server
+// answers with an error and the warn level when it fails otherwise. A
+// *slog.Logger will do, and decides which levels are kept. Job bodies are left
+// out unless WithPayloadLogging is given too.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithPayloadLogging includes the bodies of the jobs put and received in the
+// log of each command. Job bodies may hold sensitive data, so they are not
+// logged by default.
+func WithPayloadLogging() Option {
+	return func(o *options) {
+		o.logPayloads = true
+	}
+}
+
+// WithMetrics reports each command the client runs, and the bytes it sends
+// and receives, to metrics. The metrics package has an implementation.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithObserver calls observer around each command the client runs, for
+// instance to trace them. See the tracing package for an adapter.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// WithEnvelopes puts the jobs the client puts in envelopes, carrying the
+// headers of the context they are put with, such as a trace context or a
+// correlation id, along with the time they were put. The jobs the client
+// reserves or peeks as a *Job are taken out of their envelopes, their
+// headers set in Job.Headers. Jobs that weren't put in an envelope are left
+// as they are, but consumers that don't use envelopes get the envelope as the
+// body.
+func WithEnvelopes() Option {
+	return func(o *options) {
+		o.envelopes = true
+	}
+}
@@ -0,0 +1,489 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("pool is closed")
+
+type PoolOpts struct {
+	// MaxOpen caps the number of connections, idle or in use. Callers wait
+	// for a connection once it is reached. Zero means no limit.
+	MaxOpen int
+	// MaxIdle is how many connections are kept around for reuse.
+	MaxIdle int
+	// IdleTimeout closes connections that have been idle for longer. Zero
+	// keeps them open.
+	IdleTimeout time.Duration
+	// HealthCheckAfter is how long a connection may sit idle before it is
+	// checked with a cheap command on its way out of the pool. Zero checks
+	// every time.
+	HealthCheckAfter time.Duration
+}
+
+func DefaultPoolOpts() PoolOpts {
+	return PoolOpts{
+		MaxOpen:          10,
+		MaxIdle:          2,
+		IdleTimeout:      5 * time.Minute,
+		HealthCheckAfter: 30 * time.Second,
+	}
+}
+
+// Pool spreads producer commands over several connections to beanstalkd, so
+// that callers don't wait on one another. Each call borrows a free connection,
+// switched to the pool's tube if needed, and returns it once done.
+//
+// A Pool is meant for producers. Consumers should keep their own Client, as
+// reserved jobs belong to the connection that reserved them.
+type Pool struct {
+	*pool
+	tube string
+}
+
+type pool struct {
+	addr       string
+	opts       PoolOpts
+	clientOpts []Option
+
+	// slots is a semaphore counting open connections, nil without MaxOpen
+	slots chan struct{}
+
+	mutex  sync.Mutex
+	idle   []idleClient
+	open   int
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type idleClient struct {
+	client *Client
+	since  time.Time
+}
+
+// NewPool creates a pool of connections to beanstalkd at addr, dialed with
+// clientOpts. Connections are only opened when needed.
+func NewPool(addr string, opts PoolOpts, clientOpts ...Option) *Pool {
+	p := &pool{
+		addr:       addr,
+		opts:       opts,
+		clientOpts: clientOpts,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if opts.MaxOpen > 0 {
+		p.slots = make(chan struct{}, opts.MaxOpen)
+	}
+
+	if opts.IdleTimeout > 0 {
+		go p.evictIdle()
+	} else {
+		close(p.done)
+	}
+
+	return &Pool{pool: p, tube: "default"}
+}
+
+// WithTube returns a view of the pool that sends jobs to tube, and peeks and
+// kicks there. It shares its connections with the original pool.
+func (pool *Pool) WithTube(tube string) *Pool {
+	return &Pool{pool: pool.pool, tube: tube}
+}
+
+// Connections returns the number of open connections, and how many of them
+// are idle.
+func (pool *Pool) Connections() (open int, idle int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.open, len(pool.idle)
+}
+
+// Close closes the idle connections and those in use as they are returned.
+// Calls made afterwards fail with ErrPoolClosed.
+func (pool *Pool) Close() error {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return nil
+	}
+	pool.closed = true
+	idle := pool.idle
+	pool.idle = nil
+	pool.mutex.Unlock()
+
+	close(pool.stop)
+	<-pool.done
+
+	for _, c := range idle {
+		pool.discard(c.client)
+	}
+	return nil
+}
+
+// with runs fn with a connection using tube, or any connection if tube is
+// empty.
+func (p *pool) with(ctx context.Context, tube string, fn func(client *Client) error) error {
+	client, err := p.get(ctx, tube)
+	if err != nil {
+		return err
+	}
+
+	err = fn(client)
+	p.put(client)
+	return err
+}
+
+func (p *pool) get(ctx context.Context, tube string) (*Client, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	client, err := p.checkout(ctx, tube)
+	if err != nil {
+		if p.slots != nil {
+			<-p.slots
+		}
+		return nil, err
+	}
+
+	if tube != "" && client.tube != tube {
+		if _, err := client.UseContext(ctx, tube); err != nil {
+			p.put(client)
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// checkout takes a healthy idle connection, preferring one that already uses
+// tube, or opens a new one.
+func (p *pool) checkout(ctx context.Context, tube string) (*Client, error) {
+	for {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.open++
+			p.mutex.Unlock()
+			break
+		}
+
+		// The most recently used connection is the least likely to be stale
+		i := len(p.idle) - 1
+		for j := i; j >= 0; j-- {
+			if p.idle[j].client.tube == tube {
+				i = j
+				break
+			}
+		}
+		c := p.idle[i]
+		p.idle = append(p.idle[:i], p.idle[i+1:]...)
+		p.mutex.Unlock()
+
+		if time.Since(c.since) < p.opts.HealthCheckAfter {
+			return c.client, nil
+		}
+		if _, err := c.client.ListTubeUsedContext(ctx); err == nil {
+			return c.client, nil
+		} else if ctx.Err() != nil {
+			p.keep(c.client)
+			return nil, ctx.Err()
+		}
+
+		// The connection went bad while idle
+		p.discard(c.client)
+	}
+
+	client, err := DialContext(ctx, p.addr, p.clientOpts...)
+	if err != nil {
+		p.mutex.Lock()
+		p.open--
+		p.mutex.Unlock()
+		return nil, err
+	}
+	return client, nil
+}
+
+// put returns a connection obtained by get to the pool. It must be called
+// exactly once per connection.
+func (p *pool) put(client *Client) {
+	if p.slots != nil {
+		defer func() { <-p.slots }()
+	}
+	p.keep(client)
+}
+
+// keep adds a connection to the idle ones, unless it is broken or not needed.
+func (p *pool) keep(client *Client) {
+	if atomic.LoadInt32(&client.closed) == 1 {
+		p.discard(client)
+		return
+	}
+
+	p.mutex.Lock()
+	if p.closed || len(p.idle) >= p.opts.MaxIdle {
+		p.mutex.Unlock()
+		p.discard(client)
+		return
+	}
+	p.idle = append(p.idle, idleClient{client: client, since: time.Now()})
+	p.mutex.Unlock()
+}
+
+// discard closes a connection taken out of the pool.
+func (p *pool) discard(client *Client) {
+	p.mutex.Lock()
+	p.open--
+	p.mutex.Unlock()
+
+	client.Quit()
+}
+
+func (p *pool) evictIdle() {
+	defer close(p.done)
+
+	// Tiny timeouts would make for a busy or, once halved to zero, invalid
+	// ticker
+	interval := p.opts.IdleTimeout / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+
+		var expired []*Client
+		p.mutex.Lock()
+		kept := p.idle[:0]
+		for _, c := range p.idle {
+			if time.Since(c.since) >= p.opts.IdleTimeout {
+				expired = append(expired, c.client)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		p.idle = kept
+		p.mutex.Unlock()
+
+		for _, client := range expired {
+			p.discard(client)
+		}
+	}
+}
+
+func (pool *Pool) Put(body []byte, opts PutOpts) (uint32, error) {
+	return pool.PutContext(context.Background(), body, opts)
+}
+
+func (pool *Pool) PutContext(ctx context.Context, body []byte, opts PutOpts) (id uint32, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		id, err = client.PutContext(ctx, body, opts)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) PutReader(r io.Reader, size int64, opts PutOpts) (uint32, error) {
+	return pool.PutReaderContext(context.Background(), r, size, opts)
+}
+
+func (pool *Pool) PutReaderContext(ctx context.Context, r io.Reader, size int64, opts PutOpts) (id uint32, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		id, err = client.PutReaderContext(ctx, r, size, opts)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) PutMany(jobs []PutJob) ([]uint32, error) {
+	return pool.PutManyContext(context.Background(), jobs)
+}
+
+func (pool *Pool) PutManyContext(ctx context.Context, jobs []PutJob) (ids []uint32, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		ids, err = client.PutManyContext(ctx, jobs)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) Delete(job uint32) error {
+	return pool.DeleteContext(context.Background(), job)
+}
+
+func (pool *Pool) DeleteContext(ctx context.Context, job uint32) error {
+	return pool.with(ctx, "", func(client *Client) error {
+		return client.DeleteContext(ctx, job)
+	})
+}
+
+func (pool *Pool) DeleteMany(jobs []uint32) error {
+	return pool.DeleteManyContext(context.Background(), jobs)
+}
+
+func (pool *Pool) DeleteManyContext(ctx context.Context, jobs []uint32) error {
+	return pool.with(ctx, "", func(client *Client) error {
+		return client.DeleteManyContext(ctx, jobs)
+	})
+}
+
+func (pool *Pool) Kick(numJobs uint32) (uint32, error) {
+	return pool.KickContext(context.Background(), numJobs)
+}
+
+func (pool *Pool) KickContext(ctx context.Context, numJobs uint32) (kicked uint32, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		kicked, err = client.KickContext(ctx, numJobs)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) KickJob(id uint32) error {
+	return pool.KickJobContext(context.Background(), id)
+}
+
+func (pool *Pool) KickJobContext(ctx context.Context, id uint32) error {
+	return pool.with(ctx, "", func(client *Client) error {
+		return client.KickJobContext(ctx, id)
+	})
+}
+
+func (pool *Pool) KickJobs(jobs []uint32) error {
+	return pool.KickJobsContext(context.Background(), jobs)
+}
+
+func (pool *Pool) KickJobsContext(ctx context.Context, jobs []uint32) error {
+	return pool.with(ctx, "", func(client *Client) error {
+		return client.KickJobsContext(ctx, jobs)
+	})
+}
+
+func (pool *Pool) Peek(job uint32) (uint32, []byte, error) {
+	return pool.PeekContext(context.Background(), job)
+}
+
+func (pool *Pool) PeekContext(ctx context.Context, job uint32) (id uint32, body []byte, err error) {
+	err = pool.with(ctx, "", func(client *Client) error {
+		id, body, err = client.PeekContext(ctx, job)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) PeekReady() (uint32, []byte, error) {
+	return pool.PeekReadyContext(context.Background())
+}
+
+func (pool *Pool) PeekReadyContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		id, body, err = client.PeekReadyContext(ctx)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) PeekDelayed() (uint32, []byte, error) {
+	return pool.PeekDelayedContext(context.Background())
+}
+
+func (pool *Pool) PeekDelayedContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		id, body, err = client.PeekDelayedContext(ctx)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) PeekBuried() (uint32, []byte, error) {
+	return pool.PeekBuriedContext(context.Background())
+}
+
+func (pool *Pool) PeekBuriedContext(ctx context.Context) (id uint32, body []byte, err error) {
+	err = pool.with(ctx, pool.tube, func(client *Client) error {
+		id, body, err = client.PeekBuriedContext(ctx)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) Stats() ([]byte, error) {
+	return pool.StatsContext(context.Background())
+}
+
+func (pool *Pool) StatsContext(ctx context.Context) (body []byte, err error) {
+	err = pool.with(ctx, "", func(client *Client) error {
+		body, err = client.StatsContext(ctx)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) ServerStats() (*ServerStats, error) {
+	return pool.ServerStatsContext(context.Background())
+}
+
+func (pool *Pool) ServerStatsContext(ctx context.Context) (stats *ServerStats, err error) {
+	err = pool.with(ctx, "", func(client *Client) error {
+		stats, err = client.ServerStatsContext(ctx)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) TubeStats(tube string) (*TubeStats, error) {
+	return pool.TubeStatsContext(context.Background(), tube)
+}
+
+func (pool *Pool) TubeStatsContext(ctx context.Context, tube string) (stats *TubeStats, err error) {
+	err = pool.with(ctx, "", func(client *Client) error {
+		stats, err = client.TubeStatsContext(ctx, tube)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) JobStats(id uint32) (*JobStats, error) {
+	return pool.JobStatsContext(context.Background(), id)
+}
+
+func (pool *Pool) JobStatsContext(ctx context.Context, id uint32) (stats *JobStats, err error) {
+	err = pool.with(ctx, "", func(client *Client) error {
+		stats, err = client.JobStatsContext(ctx, id)
+		return err
+	})
+	return
+}
+
+func (pool *Pool) Tubes() ([]string, error) {
+	return pool.TubesContext(context.Background())
+}
+
+func (pool *Pool) TubesContext(ctx context.Context) (tubes []string, err error) {
+	err = pool.with(ctx, "", func(client *Client) error {
+		tubes, err = client.TubesContext(ctx)
+		return err
+	})
+	return
+}
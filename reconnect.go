@@ -0,0 +1,212 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOutcomeUnknown is returned by a reconnecting client when the connection
+// was lost halfway through a command that isn't safe to run twice, such as a
+// put. The command may or may not have taken effect.
+var ErrOutcomeUnknown = errors.New("connection lost, outcome of the command is unknown")
+
+// Backoff decides how long a reconnecting client waits between attempts to
+// connect again.
+type Backoff interface {
+	// Next returns the delay before the next attempt after the given number
+	// of failed attempts, or false to give up.
+	Next(failures int) (time.Duration, bool)
+}
+
+// ConstantBackoff waits the same delay between attempts. A zero MaxAttempts
+// never gives up.
+type ConstantBackoff struct {
+	Delay       time.Duration
+	MaxAttempts int
+}
+
+func (b ConstantBackoff) Next(failures int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && failures >= b.MaxAttempts {
+		return 0, false
+	}
+	return b.Delay, true
+}
+
+// ExponentialBackoff multiplies the delay between attempts by Multiplier,
+// starting from Initial and up to Max. Multiplier defaults to 2. Jitter
+// randomizes each delay by up to that fraction of it, so that many clients
+// don't all reconnect at the same moment. A zero MaxAttempts never gives up.
+type ExponentialBackoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int
+}
+
+func (b ExponentialBackoff) Next(failures int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && failures >= b.MaxAttempts {
+		return 0, false
+	}
+
+	multiplier := b.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(failures-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay), true
+}
+
+// FibonacciBackoff grows the delay between attempts along the Fibonacci
+// sequence, in multiples of Unit and up to Max. It grows more gently than an
+// exponential backoff. A zero MaxAttempts never gives up.
+type FibonacciBackoff struct {
+	Unit        time.Duration
+	Max         time.Duration
+	MaxAttempts int
+}
+
+func (b FibonacciBackoff) Next(failures int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && failures >= b.MaxAttempts {
+		return 0, false
+	}
+
+	previous, current := time.Duration(0), b.Unit
+	for i := 1; i < failures; i++ {
+		previous, current = current, previous+current
+		if b.Max > 0 && current >= b.Max {
+			return b.Max, true
+		}
+	}
+
+	return current, true
+}
+
+// reconnect replaces a broken connection and restores the session on the new
+// one. It must be called with the lock held.
+func (jackd *Client) reconnect(ctx context.Context) error {
+	if jackd.dial == nil || jackd.backoff == nil || atomic.LoadInt32(&jackd.quit) == 1 {
+		return ErrClosed
+	}
+
+	// Let the commands still waiting on the old connection fail first
+	select {
+	case <-jackd.turn:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for failures := 0; ; {
+		err := jackd.redial(ctx)
+		if err == nil {
+			if jackd.logger != nil {
+				jackd.logger.Info("reconnected", "attempts", failures+1)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		failures++
+		delay, ok := jackd.backoff.Next(failures)
+		if jackd.logger != nil {
+			jackd.logger.Warn("reconnecting failed", "attempts", failures, "error", err, "giving_up", !ok)
+		}
+		if !ok {
+			return fmt.Errorf("reconnecting: %w", err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (jackd *Client) redial(ctx context.Context) error {
+	conn, err := jackd.dial(ctx)
+	if err != nil {
+		return err
+	}
+	jackd.setConn(conn)
+
+	if c, ok := conn.(deadlineConn); ok && jackd.ioTimeout > 0 {
+		_ = c.SetDeadline(time.Now().Add(jackd.ioTimeout))
+	}
+
+	interrupted := jackd.interruptOnDone(ctx)
+	err = jackd.restoreSession()
+	if interrupted() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	atomic.StoreInt32(&jackd.closed, 0)
+	return nil
+}
+
+// restoreSession replays the use, watch and ignore commands that shaped the
+// session on the old connection, since a new one starts out with the defaults.
+func (jackd *Client) restoreSession() error {
+	var commands []string
+	if jackd.tube != "default" {
+		commands = append(commands, "use "+jackd.tube)
+	}
+	watchingDefault := false
+	for _, tube := range jackd.watching {
+		if tube == "default" {
+			watchingDefault = true
+			continue
+		}
+		commands = append(commands, "watch "+tube)
+	}
+	// Only once the other tubes are watched, as the last one can't be ignored
+	if !watchingDefault {
+		commands = append(commands, "ignore default")
+	}
+
+	for _, command := range commands {
+		if _, err := fmt.Fprintf(jackd.buffer, "%s\r\n", command); err != nil {
+			return err
+		}
+	}
+	if err := jackd.buffer.Flush(); err != nil {
+		return err
+	}
+
+	for range commands {
+		resp, err := jackd.readLine()
+		if err != nil {
+			return err
+		}
+		if err := validate(resp, []string{NotIgnored}); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(resp, "USING ") && !strings.HasPrefix(resp, "WATCHING ") {
+			return unexpectedResponseError(resp)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package jackd
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy decides what becomes of a job whose processing failed.
+type RetryPolicy interface {
+	// Retry returns the delay to release the job with, or false to bury it
+	// instead. stats describes the job as it was when processing failed, and
+	// err is why it failed.
+	Retry(stats *JobStats, err error) (time.Duration, bool)
+}
+
+// DefaultRetryPolicy releases a failed job after 10 seconds, doubling the
+// delay with each attempt up to an hour, and buries it after the tenth. The
+// delays are jittered by up to 20%, so that jobs failing together, say when a
+// dependency is down, aren't all retried at the same moment.
+func DefaultRetryPolicy() RetryPolicy {
+	return ExponentialBackoff{
+		Initial:     10 * time.Second,
+		Max:         time.Hour,
+		Jitter:      0.2,
+		MaxAttempts: 10,
+	}
+}
+
+// The backoffs double as retry policies, counting each reservation of a job as
+// a failed attempt. Their MaxAttempts then caps how many times a job is
+// reserved before it is buried.
+
+func (b ConstantBackoff) Retry(stats *JobStats, err error) (time.Duration, bool) {
+	return b.Next(int(stats.Reserves))
+}
+
+func (b ExponentialBackoff) Retry(stats *JobStats, err error) (time.Duration, bool) {
+	return b.Next(int(stats.Reserves))
+}
+
+func (b FibonacciBackoff) Retry(stats *JobStats, err error) (time.Duration, bool) {
+	return b.Next(int(stats.Reserves))
+}
+
+// Retry releases or buries the job after its processing failed with err, as
+// policy decides. The job keeps its priority either way.
+func (job *Job) Retry(policy RetryPolicy, err error) error {
+	return job.RetryContext(context.Background(), policy, err)
+}
+
+func (job *Job) RetryContext(ctx context.Context, policy RetryPolicy, err error) error {
+	if job.Finalized() {
+		return ErrJobFinalized
+	}
+
+	opts, retry, statsErr := job.retryOpts(ctx, policy, err)
+	if statsErr != nil {
+		return statsErr
+	}
+
+	if !retry {
+		return job.BuryContext(ctx, opts.Priority)
+	}
+	return job.ReleaseContext(ctx, opts)
+}
+
+// retryOpts asks policy what to do with the job, returning the options to
+// release it with and whether to release it at all.
+func (job *Job) retryOpts(ctx context.Context, policy RetryPolicy, err error) (ReleaseOpts, bool, error) {
+	stats, statsErr := job.StatsContext(ctx)
+	if statsErr != nil {
+		return ReleaseOpts{}, false, statsErr
+	}
+
+	delay, retry := policy.Retry(stats, err)
+	return ReleaseOpts{Priority: stats.Priority, Delay: delay}, retry, nil
+}
@@ -0,0 +1,255 @@
+package jackd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+type JobState int
+
+const (
+	JobStateUnknown JobState = iota
+	JobStateReady
+	JobStateDelayed
+	JobStateReserved
+	JobStateBuried
+)
+
+var jobStateNames = map[JobState]string{
+	JobStateReady:    "ready",
+	JobStateDelayed:  "delayed",
+	JobStateReserved: "reserved",
+	JobStateBuried:   "buried",
+}
+
+func (s JobState) String() string {
+	if name, ok := jobStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func parseJobState(name string) JobState {
+	for state, stateName := range jobStateNames {
+		if stateName == name {
+			return state
+		}
+	}
+	return JobStateUnknown
+}
+
+// ServerStats is the parsed response of the stats command. Durations reported
+// by beanstalkd in seconds are converted to time.Duration.
+type ServerStats struct {
+	CurrentJobsUrgent     uint64        `yaml:"current-jobs-urgent"`
+	CurrentJobsReady      uint64        `yaml:"current-jobs-ready"`
+	CurrentJobsReserved   uint64        `yaml:"current-jobs-reserved"`
+	CurrentJobsDelayed    uint64        `yaml:"current-jobs-delayed"`
+	CurrentJobsBuried     uint64        `yaml:"current-jobs-buried"`
+	CmdPut                uint64        `yaml:"cmd-put"`
+	CmdPeek               uint64        `yaml:"cmd-peek"`
+	CmdPeekReady          uint64        `yaml:"cmd-peek-ready"`
+	CmdPeekDelayed        uint64        `yaml:"cmd-peek-delayed"`
+	CmdPeekBuried         uint64        `yaml:"cmd-peek-buried"`
+	CmdReserve            uint64        `yaml:"cmd-reserve"`
+	CmdReserveWithTimeout uint64        `yaml:"cmd-reserve-with-timeout"`
+	CmdTouch              uint64        `yaml:"cmd-touch"`
+	CmdUse                uint64        `yaml:"cmd-use"`
+	CmdWatch              uint64        `yaml:"cmd-watch"`
+	CmdIgnore             uint64        `yaml:"cmd-ignore"`
+	CmdDelete             uint64        `yaml:"cmd-delete"`
+	CmdRelease            uint64        `yaml:"cmd-release"`
+	CmdBury               uint64        `yaml:"cmd-bury"`
+	CmdKick               uint64        `yaml:"cmd-kick"`
+	CmdStats              uint64        `yaml:"cmd-stats"`
+	CmdStatsJob           uint64        `yaml:"cmd-stats-job"`
+	CmdStatsTube          uint64        `yaml:"cmd-stats-tube"`
+	CmdListTubes          uint64        `yaml:"cmd-list-tubes"`
+	CmdListTubeUsed       uint64        `yaml:"cmd-list-tube-used"`
+	CmdListTubesWatched   uint64        `yaml:"cmd-list-tubes-watched"`
+	CmdPauseTube          uint64        `yaml:"cmd-pause-tube"`
+	JobTimeouts           uint64        `yaml:"job-timeouts"`
+	TotalJobs             uint64        `yaml:"total-jobs"`
+	MaxJobSize            uint64        `yaml:"max-job-size"`
+	CurrentTubes          uint64        `yaml:"current-tubes"`
+	CurrentConnections    uint64        `yaml:"current-connections"`
+	CurrentProducers      uint64        `yaml:"current-producers"`
+	CurrentWorkers        uint64        `yaml:"current-workers"`
+	CurrentWaiting        uint64        `yaml:"current-waiting"`
+	TotalConnections      uint64        `yaml:"total-connections"`
+	PID                   int64         `yaml:"pid"`
+	Version               string        `yaml:"version"`
+	RusageUtime           time.Duration `yaml:"rusage-utime"`
+	RusageStime           time.Duration `yaml:"rusage-stime"`
+	Uptime                time.Duration `yaml:"uptime"`
+	BinlogOldestIndex     int64         `yaml:"binlog-oldest-index"`
+	BinlogCurrentIndex    int64         `yaml:"binlog-current-index"`
+	BinlogRecordsMigrated int64         `yaml:"binlog-records-migrated"`
+	BinlogRecordsWritten  int64         `yaml:"binlog-records-written"`
+	BinlogMaxSize         int64         `yaml:"binlog-max-size"`
+	Draining              bool          `yaml:"draining"`
+	ID                    string        `yaml:"id"`
+	Hostname              string        `yaml:"hostname"`
+	OS                    string        `yaml:"os"`
+	Platform              string        `yaml:"platform"`
+}
+
+// TubeStats is the parsed response of the stats-tube command.
+type TubeStats struct {
+	Name                string        `yaml:"name"`
+	CurrentJobsUrgent   uint64        `yaml:"current-jobs-urgent"`
+	CurrentJobsReady    uint64        `yaml:"current-jobs-ready"`
+	CurrentJobsReserved uint64        `yaml:"current-jobs-reserved"`
+	CurrentJobsDelayed  uint64        `yaml:"current-jobs-delayed"`
+	CurrentJobsBuried   uint64        `yaml:"current-jobs-buried"`
+	TotalJobs           uint64        `yaml:"total-jobs"`
+	CurrentUsing        uint64        `yaml:"current-using"`
+	CurrentWatching     uint64        `yaml:"current-watching"`
+	CurrentWaiting      uint64        `yaml:"current-waiting"`
+	CmdDelete           uint64        `yaml:"cmd-delete"`
+	CmdPauseTube        uint64        `yaml:"cmd-pause-tube"`
+	Pause               time.Duration `yaml:"pause"`
+	PauseTimeLeft       time.Duration `yaml:"pause-time-left"`
+}
+
+// JobStats is the parsed response of the stats-job command.
+type JobStats struct {
+	ID       uint32        `yaml:"id"`
+	Tube     string        `yaml:"tube"`
+	State    JobState      `yaml:"state"`
+	Priority uint32        `yaml:"pri"`
+	Age      time.Duration `yaml:"age"`
+	Delay    time.Duration `yaml:"delay"`
+	TTR      time.Duration `yaml:"ttr"`
+	TimeLeft time.Duration `yaml:"time-left"`
+	File     int64         `yaml:"file"`
+	Reserves uint32        `yaml:"reserves"`
+	Timeouts uint32        `yaml:"timeouts"`
+	Releases uint32        `yaml:"releases"`
+	Buries   uint32        `yaml:"buries"`
+	Kicks    uint32        `yaml:"kicks"`
+}
+
+func (jackd *Client) ServerStats() (*ServerStats, error) {
+	return jackd.ServerStatsContext(context.Background())
+}
+
+func (jackd *Client) ServerStatsContext(ctx context.Context) (*ServerStats, error) {
+	body, err := jackd.StatsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := new(ServerStats)
+	if err := decodeStats(body, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (jackd *Client) TubeStats(tube string) (*TubeStats, error) {
+	return jackd.TubeStatsContext(context.Background(), tube)
+}
+
+func (jackd *Client) TubeStatsContext(ctx context.Context, tube string) (*TubeStats, error) {
+	body, err := jackd.StatsTubeContext(ctx, tube)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := new(TubeStats)
+	if err := decodeStats(body, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (jackd *Client) JobStats(id uint32) (*JobStats, error) {
+	return jackd.JobStatsContext(context.Background(), id)
+}
+
+func (jackd *Client) JobStatsContext(ctx context.Context, id uint32) (*JobStats, error) {
+	body, err := jackd.StatsJobContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := new(JobStats)
+	if err := decodeStats(body, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var jobStateType = reflect.TypeOf(JobStateUnknown)
+
+// decodeStats fills the fields of the struct pointed to by v from a stats
+// response, matching keys against the fields' yaml tags. Keys unknown to the
+// struct are ignored so that newer beanstalkd versions remain compatible.
+func decodeStats(body []byte, v interface{}) error {
+	dict, err := parseYAMLDict(body)
+	if err != nil {
+		return err
+	}
+
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		key := value.Type().Field(i).Tag.Get("yaml")
+		raw, ok := dict[key]
+		if !ok {
+			continue
+		}
+
+		if err := setStatsField(value.Field(i), raw); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func setStatsField(field reflect.Value, raw string) error {
+	switch field.Type() {
+	case durationType:
+		seconds, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(seconds * float64(time.Second)))
+		return nil
+	case jobStateType:
+		field.SetInt(int64(parseJobState(raw)))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+// Package tracing turns the commands of jackd clients into spans, without
+// depending on a tracing SDK. Tracer and Span are shaped after OpenTelemetry's
+// API, so that adapting a tracer of it takes a few lines:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, tracing.Span) {
+//		ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ span trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value interface{}) {
+//		s.span.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+//	}
+//
+//	func (s otelSpan) RecordError(err error) {
+//		s.span.RecordError(err)
+//		s.span.SetStatus(codes.Error, err.Error())
+//	}
+//
+//	func (s otelSpan) End() { s.span.End() }
+//
+//	client, err := jackd.Dial(addr, jackd.WithObserver(tracing.NewObserver(otelTracer{tracer})))
+package tracing
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getjackd/go-jackd"
+)
+
+// Tracer starts spans.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+type spanKey struct{}
+
+type observer struct {
+	tracer Tracer
+}
+
+// NewObserver makes a jackd.Observer that traces each command in a span named
+// after it, such as "beanstalkd put". The spans carry the attributes of
+// OpenTelemetry's messaging conventions: messaging.system,
+// messaging.operation, messaging.destination.name and messaging.message.id,
+// as well as beanstalkd.args.
+func NewObserver(tracer Tracer) jackd.Observer {
+	return observer{tracer: tracer}
+}
+
+func (o observer) BeforeCommand(ctx context.Context, info *jackd.CommandInfo) context.Context {
+	ctx, span := o.tracer.Start(ctx, "beanstalkd "+info.Command)
+	span.SetAttribute("messaging.system", "beanstalkd")
+	span.SetAttribute("messaging.operation", info.Command)
+	if len(info.Args) > 0 {
+		span.SetAttribute("beanstalkd.args", strings.Join(info.Args, " "))
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func (o observer) AfterCommand(ctx context.Context, info *jackd.CommandInfo) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	if !ok {
+		return
+	}
+
+	if info.Tube != "" {
+		span.SetAttribute("messaging.destination.name", info.Tube)
+	}
+	if info.JobID != 0 {
+		span.SetAttribute("messaging.message.id", info.JobID)
+	}
+	if info.Err != nil {
+		span.RecordError(info.Err)
+	}
+	span.End()
+}
+
+// Recorder is a Tracer keeping its spans in memory, for tests and debugging.
+type Recorder struct {
+	mutex sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span started by a Recorder. Its fields must not be read
+// before it has ended.
+type RecordedSpan struct {
+	Name string
+	// Parent is the span that was in the context the span was started with.
+	Parent     *RecordedSpan
+	Attributes map[string]interface{}
+	Errors     []error
+	Start      time.Time
+	End        time.Time
+
+	recorder *Recorder
+}
+
+type recordedSpanKey struct{}
+
+func (r *Recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	span := &RecordedSpan{
+		Name:       name,
+		Parent:     parent,
+		Attributes: make(map[string]interface{}),
+		Start:      time.Now(),
+		recorder:   r,
+	}
+	return context.WithValue(ctx, recordedSpanKey{}, span), recordedSpan{span}
+}
+
+// Spans returns the spans that have ended, in the order they ended.
+func (r *Recorder) Spans() []*RecordedSpan {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]*RecordedSpan(nil), r.spans...)
+}
+
+// recordedSpan is the Span of a RecordedSpan, keeping the methods that
+// modify it out of its exported API.
+type recordedSpan struct {
+	span *RecordedSpan
+}
+
+func (s recordedSpan) SetAttribute(key string, value interface{}) {
+	s.span.Attributes[key] = value
+}
+
+func (s recordedSpan) RecordError(err error) {
+	s.span.Errors = append(s.span.Errors, err)
+}
+
+func (s recordedSpan) End() {
+	s.span.End = time.Now()
+
+	r := s.span.recorder
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.spans = append(r.spans, s.span)
+}
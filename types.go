@@ -2,16 +2,51 @@ package jackd
 
 import (
 	"bufio"
-	"net"
-	"sync"
+	"context"
+	"io"
 	"time"
 )
 
 type Client struct {
-	conn    net.Conn
-	buffer  *bufio.ReadWriter
-	scanner *bufio.Scanner
-	mutex   *sync.Mutex
+	// The connection and what wraps it, replaced when reconnecting. Guarded
+	// by lock, and by turn while reading.
+	conn      io.ReadWriteCloser
+	transport *transport
+	buffer    *bufio.ReadWriter
+	// lock is a semaphore rather than a mutex so that callers waiting on a
+	// busy connection can give up when their context is done.
+	lock chan struct{}
+	// closed is set atomically once the connection is no longer usable, and
+	// quit once the client is done for good.
+	closed int32
+	quit   int32
+
+	// dial opens a new connection when reconnecting with backoff, and is nil
+	// for clients made by NewClient.
+	dial    func(ctx context.Context) (io.ReadWriteCloser, error)
+	backoff Backoff
+
+	pipelined bool
+	ioTimeout time.Duration
+	envelopes bool
+
+	logger      Logger
+	logPayloads bool
+	metrics     Metrics
+	observer    Observer
+	// current is the operation whose response is being read. Only touched
+	// while reading responses, like tube and watching below.
+	current *operation
+
+	// turn is closed once the response to the last command written has been
+	// read. Guarded by lock.
+	turn chan struct{}
+
+	// The tube in use and the tubes watched, as last acknowledged by the
+	// server. Only touched while reading responses, which happens one
+	// command at a time.
+	tube     string
+	watching []string
 }
 
 type PutOpts struct {
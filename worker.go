@@ -0,0 +1,316 @@
+package jackd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var ErrWorkerRunning = errors.New("worker is already running")
+var ErrWorkerNotRunning = errors.New("worker is not running")
+
+// Handler processes a reserved job. When it returns nil the job is deleted,
+// and when it fails the job is released or buried, unless the handler took
+// care of the job itself. ctx is cancelled if the worker is stopped before the
+// handler returns.
+type Handler func(ctx context.Context, job *Job) error
+
+type WorkerOpts struct {
+	// Tubes are the tubes to reserve jobs from.
+	Tubes []string
+	// Concurrency is the number of jobs processed at once, each on its own
+	// connection.
+	Concurrency int
+	// Release is the priority and delay a job is released with when its
+	// handler fails. The priority is also used for burying.
+	Release ReleaseOpts
+	// BuryOnError buries jobs whose handler failed instead of releasing them.
+	BuryOnError bool
+	// RetryPolicy, if set, decides whether a job whose handler failed is
+	// released, and with which delay, or buried. It takes precedence over
+	// Release and BuryOnError.
+	RetryPolicy RetryPolicy
+	// DeadLetterTube, if set, is where jobs go instead of being buried, along
+	// with why they failed. See Job.DeadLetter.
+	DeadLetterTube string
+	// KeepAlive touches jobs while their handler runs, so that handlers may
+	// take longer than the jobs' time-to-run. See Job.KeepAlive.
+	KeepAlive bool
+	// OnTouchFailed, if set, is called when keeping a job alive fails. The
+	// handler keeps running, but the job may have been handed to another
+	// worker already.
+	OnTouchFailed func(job *Job, err error)
+	// Middleware wraps the handler, the first middleware being the
+	// outermost. See Chain.
+	Middleware []Middleware
+	// OnError, if set, is called with the errors of failed handlers, and with
+	// a nil job for the errors of the worker itself, such as failing to
+	// reserve or delete a job.
+	OnError func(job *Job, err error)
+}
+
+func DefaultWorkerOpts() WorkerOpts {
+	return WorkerOpts{
+		Tubes:       []string{"default"},
+		Concurrency: 1,
+		KeepAlive:   true,
+		Release: ReleaseOpts{
+			Priority: 0,
+			Delay:    10 * time.Second,
+		},
+	}
+}
+
+// PanicError is the error a handler is considered to have failed with when it
+// panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+// Worker reserves jobs from a set of tubes and hands them to a Handler.
+type Worker struct {
+	addr       string
+	handler    Handler
+	opts       WorkerOpts
+	clientOpts []Option
+
+	mutex         sync.Mutex
+	running       bool
+	clients       []*Client
+	stopReserving context.CancelFunc
+	abort         context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// NewWorker creates a worker for beanstalkd at addr. Its connections are
+// dialed with clientOpts, and reconnect every second unless clientOpts include
+// a WithReconnect option.
+func NewWorker(addr string, handler Handler, opts WorkerOpts, clientOpts ...Option) *Worker {
+	if len(opts.Tubes) == 0 {
+		opts.Tubes = []string{"default"}
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if newOptions(clientOpts).backoff == nil {
+		clientOpts = append(clientOpts, WithReconnect(ConstantBackoff{Delay: time.Second}))
+	}
+
+	return &Worker{
+		addr:       addr,
+		handler:    Chain(opts.Middleware...)(handler),
+		opts:       opts,
+		clientOpts: clientOpts,
+	}
+}
+
+// Start connects the worker and starts processing jobs in the background.
+// Cancelling ctx stops the worker abruptly, as if Stop timed out.
+func (worker *Worker) Start(ctx context.Context) error {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	if worker.running {
+		return ErrWorkerRunning
+	}
+
+	var clients []*Client
+	for i := 0; i < worker.opts.Concurrency; i++ {
+		client, err := worker.dial(ctx)
+		if err != nil {
+			for _, client := range clients {
+				client.Quit()
+			}
+			return err
+		}
+		clients = append(clients, client)
+	}
+
+	handlerCtx, abort := context.WithCancel(ctx)
+	reserveCtx, stopReserving := context.WithCancel(handlerCtx)
+
+	worker.running = true
+	worker.clients = clients
+	worker.stopReserving = stopReserving
+	worker.abort = abort
+
+	for _, client := range clients {
+		worker.wg.Add(1)
+		go worker.run(reserveCtx, handlerCtx, client)
+	}
+
+	return nil
+}
+
+// Stop stops reserving jobs and waits for the jobs being processed to finish.
+// If ctx is done first, the handlers' contexts are cancelled and ctx.Err() is
+// returned once they have returned.
+func (worker *Worker) Stop(ctx context.Context) error {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	if !worker.running {
+		return ErrWorkerNotRunning
+	}
+	worker.stopReserving()
+
+	done := make(chan struct{})
+	go func() {
+		worker.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		worker.abort()
+		<-done
+	}
+	worker.abort()
+
+	for _, client := range worker.clients {
+		client.Quit()
+	}
+	worker.clients = nil
+	worker.running = false
+
+	return err
+}
+
+func (worker *Worker) dial(ctx context.Context) (*Client, error) {
+	client, err := DialContext(ctx, worker.addr, worker.clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	watchingDefault := false
+	for _, tube := range worker.opts.Tubes {
+		if tube == "default" {
+			watchingDefault = true
+			continue
+		}
+		if _, err := client.WatchContext(ctx, tube); err != nil {
+			client.Quit()
+			return nil, err
+		}
+	}
+	if !watchingDefault {
+		if _, err := client.IgnoreContext(ctx, "default"); err != nil {
+			client.Quit()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (worker *Worker) run(reserveCtx context.Context, handlerCtx context.Context, client *Client) {
+	defer worker.wg.Done()
+
+	for {
+		job, err := client.ReserveNextJobContext(reserveCtx)
+		if err != nil {
+			if reserveCtx.Err() != nil {
+				return
+			}
+			// A job left reserved by a failed settle makes every reserve
+			// return DEADLINE_SOON until its time-to-run is up, which is
+			// no news to report
+			if !errors.Is(err, ErrDeadlineSoon) {
+				worker.report(nil, err)
+			}
+			// Don't spin on a connection that keeps failing
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-reserveCtx.Done():
+				return
+			}
+		}
+
+		worker.process(handlerCtx, job)
+	}
+}
+
+func (worker *Worker) process(ctx context.Context, job *Job) {
+	stopKeepAlive := func() {}
+	if worker.opts.KeepAlive {
+		stopKeepAlive = job.KeepAlive(ctx, worker.opts.OnTouchFailed)
+	}
+
+	err := worker.handle(job.Context(ctx), job)
+	stopKeepAlive()
+	if job.Finalized() {
+		return
+	}
+
+	// Settle the job even if the worker is being stopped
+	var settleErr error
+	if err == nil {
+		settleErr = job.Delete()
+	} else {
+		worker.report(job, err)
+		settleErr = worker.fail(job, err)
+	}
+
+	if settleErr != nil {
+		worker.report(nil, fmt.Errorf("settling job %d: %w", job.ID, settleErr))
+	}
+}
+
+// fail releases, buries or dead-letters a job whose handler failed with err.
+func (worker *Worker) fail(job *Job, err error) error {
+	opts := worker.opts.Release
+	bury := worker.opts.BuryOnError
+
+	if worker.opts.RetryPolicy != nil {
+		var retry bool
+		var statsErr error
+		opts, retry, statsErr = job.retryOpts(context.Background(), worker.opts.RetryPolicy, err)
+		if statsErr != nil {
+			return statsErr
+		}
+		bury = !retry
+	}
+
+	if !bury {
+		return job.Release(opts)
+	}
+
+	if worker.opts.DeadLetterTube != "" {
+		deadLetterErr := job.DeadLetter(worker.opts.DeadLetterTube, err)
+		if deadLetterErr == nil {
+			return nil
+		}
+		worker.report(nil, fmt.Errorf("moving job %d to %s: %w", job.ID, worker.opts.DeadLetterTube, deadLetterErr))
+	}
+
+	return job.Bury(opts.Priority)
+}
+
+// handle calls the handler, turning a panic into a *PanicError.
+func (worker *Worker) handle(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	return worker.handler(ctx, job)
+}
+
+func (worker *Worker) report(job *Job, err error) {
+	if worker.opts.OnError != nil {
+		worker.opts.OnError(job, err)
+	}
+}
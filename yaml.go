@@ -0,0 +1,57 @@
+package jackd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseYAMLDict parses the flat "key: value" YAML documents returned by the
+// stats commands. Quoted values are unquoted; nothing else is interpreted.
+func parseYAMLDict(body []byte) (map[string]string, error) {
+	dict := make(map[string]string)
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if line == "" || line == "---" {
+			continue
+		}
+
+		sep := strings.Index(line, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("malformed stats line: %q", line)
+		}
+
+		value := strings.TrimSpace(line[sep+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		dict[line[:sep]] = value
+	}
+
+	return dict, nil
+}
+
+// parseYAMLList parses the YAML sequences of tube names returned by
+// list-tubes and list-tubes-watched. Tube names may use any of the characters
+// beanstalkd allows (letters, digits and -+/;.$_()), so items are taken
+// verbatim instead of being interpreted as YAML scalars; a tube named "123"
+// or "true" stays a string.
+func parseYAMLList(body []byte) ([]string, error) {
+	items := make([]string, 0)
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || line == "---" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "- ") {
+			return nil, fmt.Errorf("malformed list line: %q", line)
+		}
+
+		items = append(items, line[2:])
+	}
+
+	return items, nil
+}